@@ -10,8 +10,10 @@ package dnsserver
 // (after) them during a request, but they must not
 // care what plugin above them are doing.
 var Directives = []string{
+	"metadata",
+	"prometheus",
+	"log",
 	"untangle",
 	"debug",
-	"log",
 	"forward",
 }
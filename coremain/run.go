@@ -25,6 +25,7 @@ func init() {
 	flag.StringVar(&caddy.PidFile, "pidfile", "", "Path to write pid file")
 	flag.BoolVar(&version, "version", false, "Show version")
 	flag.BoolVar(&dnsserver.Quiet, "quiet", false, "Quiet mode (no initialization output)")
+	flag.StringVar(&validatePolicy, "validate-policy", "", "Validate an untangle policy file and exit")
 
 	caddy.RegisterCaddyfileLoader("flag", caddy.LoaderFunc(confLoader))
 	caddy.SetDefaultCaddyfileLoader("default", caddy.LoaderFunc(defaultLoader))
@@ -68,6 +69,17 @@ func Run() {
 		fmt.Println(caddy.DescribePlugins())
 		os.Exit(0)
 	}
+	if validatePolicy != "" {
+		if PolicyValidator == nil {
+			mustLogFatal(fmt.Errorf("no policy validator, the untangle plugin is not compiled in"))
+		}
+		if err := PolicyValidator(validatePolicy); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: OK\n", validatePolicy)
+		os.Exit(0)
+	}
 
 	// Get Corefile input
 	corefile, err := caddy.LoadCaddyfile(serverType)
@@ -179,9 +191,10 @@ func setVersion() {
 
 // Flags that control program flow or startup
 var (
-	conf    string
-	version bool
-	plugins bool
+	conf           string
+	version        bool
+	plugins        bool
+	validatePolicy string
 )
 
 // Build information obtained with the help of -ldflags
@@ -211,3 +224,7 @@ var flagsBlacklist = map[string]struct{}{
 }
 
 var flagsToKeep []*flag.Flag
+
+// PolicyValidator checks the policy file given with -validate-policy. It is
+// set by the untangle plugin, which can't be imported from here.
+var PolicyValidator func(path string) error
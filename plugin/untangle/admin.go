@@ -0,0 +1,264 @@
+/*
+ * admin.go
+ * This is the admin API of the Untangle DNS filter proxy
+ * It listens on its own HTTP address, like the health and metrics plugins,
+ * so support can see which policy applies to a client and why a name is
+ * blocked without reading the debug logs. There is no authentication, the
+ * API should only be reachable from the local host or a management network.
+ *
+ *	GET    /untangle/policy?client=CLIENT    the active policy for an address or device
+ *	POST   /untangle/lookup                  a test decision for {"client": ..., "qname": ..., "source": ...}
+ *	GET    /untangle/customers               the loaded customers and their versions
+ *	DELETE /untangle/cache?name=NAME         purge the verdict of a name from the cache
+ */
+
+package untangle
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+
+	"github.com/miekg/dns"
+)
+
+// defaultAdminAddress is where the admin API listens unless an address is given.
+const defaultAdminAddress = "127.0.0.1:8485"
+
+// admin serves the admin API for ut.
+type admin struct {
+	addr string
+	ut   *Untangle
+	ln   net.Listener
+}
+
+// adminPolicy is the answer to a policy request.
+type adminPolicy struct {
+	Client   string  `json:"client"`
+	Customer string  `json:"customer"`
+	Version  int     `json:"version"`
+	Network  string  `json:"network,omitempty"` // empty for a policy found by device
+	Policy   *Policy `json:"policy"`
+
+	// what is blocked now, following the schedules of the policy
+	BlockCategories []int `json:"blockCategories"`
+	BlockReputation int   `json:"blockReputation"`
+}
+
+// adminLookup is the body of a lookup request.
+type adminLookup struct {
+	Client string `json:"client"`
+	Name   string `json:"qname"`
+	Source string `json:"source"` // the forwarder a device queries through, optional
+}
+
+// adminDecision is the answer to a lookup request, the fields are those of
+// the events.
+type adminDecision struct {
+	Client     string `json:"client"`
+	Customer   string `json:"customer"`
+	Name       string `json:"qname"`
+	Reputation *int   `json:"reputation,omitempty"`
+	Categories []int  `json:"categories,omitempty"`
+	Action     string `json:"action"`
+	Reason     string `json:"reason,omitempty"`
+	Error      string `json:"error,omitempty"` // why the daemon lookup failed
+}
+
+// adminCustomer is a customer configuration in the answer to a customers request.
+type adminCustomer struct {
+	Customer string `json:"customer"`
+	Version  int    `json:"version"`
+	Policies int    `json:"policies"`
+	File     string `json:"file"`
+}
+
+func newAdmin(addr string, ut *Untangle) *admin {
+	return &admin{addr: addr, ut: ut}
+}
+
+// Start starts serving the admin API.
+func (a *admin) Start() error {
+	ln, err := net.Listen("tcp", a.addr)
+	if err != nil {
+		return err
+	}
+	a.ln = ln
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/untangle/policy", a.policy)
+	mux.HandleFunc("/untangle/lookup", a.lookup)
+	mux.HandleFunc("/untangle/customers", a.customers)
+	mux.HandleFunc("/untangle/cache", a.purge)
+
+	go func() { http.Serve(ln, mux) }()
+	return nil
+}
+
+// Stop stops serving the admin API.
+func (a *admin) Stop() error {
+	if a.ln == nil {
+		return nil
+	}
+	err := a.ln.Close()
+	a.ln = nil
+	return err
+}
+
+func (a *admin) policy(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	client := r.URL.Query().Get("client")
+	if client == "" {
+		http.Error(w, "client is required", http.StatusBadRequest)
+		return
+	}
+	policy, client := a.ut.lookupClient(client)
+	if policy == nil {
+		http.Error(w, "no policy for client "+client, http.StatusNotFound)
+		return
+	}
+
+	// the blocklists apply whatever schedule is active
+	reputation, categories := policy.rules(a.ut.clock())
+	categories = append(append([]int{}, categories...), policy.listCategories...)
+	writeJSON(w, adminPolicy{
+		Client:          client,
+		Customer:        policy.customerId,
+		Version:         policy.version,
+		Network:         policy.networkAddress,
+		Policy:          policy.source,
+		BlockCategories: categories,
+		BlockReputation: reputation,
+	})
+}
+
+func (a *admin) lookup(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodPost) {
+		return
+	}
+	var req adminLookup
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid lookup: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Client == "" || req.Name == "" {
+		http.Error(w, "client and qname are required", http.StatusBadRequest)
+		return
+	}
+	name := dns.Fqdn(strings.ToLower(req.Name))
+	if _, ok := dns.IsDomainName(name); !ok {
+		http.Error(w, "invalid qname "+req.Name, http.StatusBadRequest)
+		return
+	}
+	policy, client := a.ut.lookupClient(req.Client)
+	if policy == nil {
+		http.Error(w, "no policy for client "+client, http.StatusNotFound)
+		return
+	}
+
+	// the query is taken to come over UDP, and from the forwarder in source
+	// when the client is a device
+	d := &decision{customer: policy.customerId, client: client, action: "allow"}
+	_, err := a.ut.decide(name, client, rpzClient(client, req.Source), false, policy, d)
+	res := adminDecision{
+		Client:   d.client,
+		Customer: d.customer,
+		Name:     name,
+		Action:   d.action,
+		Reason:   d.reason.text,
+	}
+	if d.filter != nil {
+		reputation := d.filter.Reputation
+		res.Reputation = &reputation
+		for _, c := range d.filter.Cats {
+			res.Categories = append(res.Categories, c.Catid)
+		}
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	writeJSON(w, res)
+}
+
+func (a *admin) customers(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, a.ut.policies.customers())
+}
+
+func (a *admin) purge(w http.ResponseWriter, r *http.Request) {
+	if !allowMethod(w, r, http.MethodDelete) {
+		return
+	}
+	if a.ut.cache == nil {
+		http.Error(w, "the verdict cache is disabled", http.StatusNotFound)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if _, ok := dns.IsDomainName(name); name == "" || !ok {
+		http.Error(w, "invalid name "+name, http.StatusBadRequest)
+		return
+	}
+	name = dns.Fqdn(strings.ToLower(name))
+	a.ut.cache.remove(name)
+	log.Infof("Purged %s from the verdict cache\n", name)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// allowMethod reports if r uses method, and answers it if not.
+func allowMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("Unable to write admin answer: %v\n", err)
+	}
+}
+
+// lookupClient returns the policy for the client address or device and the
+// client in the form the policy was found for.
+func (ut *Untangle) lookupClient(client string) (*policyHolder, string) {
+	if ip := net.ParseIP(client); ip != nil {
+		return ut.policies.lookup(ip.String()), ip.String()
+	}
+	client = normalizeDevice(client)
+	return ut.policies.lookupDevice(client), client
+}
+
+// customers returns the loaded customer configurations ordered by customer
+// and file.
+func (ps *policySet) customers() []adminCustomer {
+	ps.RLock()
+	defer ps.RUnlock()
+
+	customers := make([]adminCustomer, 0, len(ps.files))
+	for path, lf := range ps.files {
+		customers = append(customers, adminCustomer{
+			Customer: lf.config.CustomerId,
+			Version:  lf.config.Version,
+			Policies: len(lf.config.Policies),
+			File:     path,
+		})
+	}
+	sort.Slice(customers, func(i, j int) bool {
+		if customers[i].Customer != customers[j].Customer {
+			return customers[i].Customer < customers[j].Customer
+		}
+		return customers[i].File < customers[j].File
+	})
+	return customers
+}
@@ -0,0 +1,320 @@
+package untangle
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+const adminCustomerA = `{
+	"version": 3,
+	"customerId": "a",
+	"policies": [
+		{
+			"ipv4Addrs": ["10.240.0.0/16"],
+			"devices": ["00:11:22:aa:bb:cc"],
+			"blockCategories": [7],
+			"allowDomains": ["allowed.example.com"],
+			"blockDomains": ["blocked.example.com"]
+		}
+	]
+}`
+
+const adminCustomerB = `{
+	"version": 1,
+	"customerId": "b",
+	"policies": [{"ipv4Addrs": ["10.2.0.0/16"]}, {"ipv4Addrs": ["10.3.0.0/16"]}]
+}`
+
+// adminUntangle returns an Untangle with the policies of customers a and b
+// and a daemon that puts every name in category 7.
+func adminUntangle(t *testing.T) (*Untangle, func()) {
+	dir, err := ioutil.TempDir("", "untangle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePolicy(t, dir, "a.json", adminCustomerA)
+	writePolicy(t, dir, "b.json", adminCustomerB)
+
+	ut := &Untangle{policies: newPolicySet(dir), onError: errorAllow}
+	if errs := ut.policies.load(); len(errs) != 0 {
+		t.Fatalf("Expected no errors, got %v", errs)
+	}
+	d := newFakeDaemon(t, categoryDaemon)
+	ut.pool = newPool(d.Addr(), 1)
+	return ut, func() {
+		ut.pool.Stop()
+		d.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestAdminPolicy(t *testing.T) {
+	ut, cleanup := adminUntangle(t)
+	defer cleanup()
+	a := newAdmin("", ut)
+
+	tests := []struct {
+		client           string
+		expectedStatus   int
+		expectedClient   string
+		expectedNetwork  string
+		expectedCustomer string
+	}{
+		{"10.240.0.1", http.StatusOK, "10.240.0.1", "10.240.0.0/16", "a"},
+		{"00-11-22-AA-BB-CC", http.StatusOK, "00:11:22:aa:bb:cc", "", "a"},
+		{"10.3.0.1", http.StatusOK, "10.3.0.1", "10.3.0.0/16", "b"},
+		{"192.0.2.1", http.StatusNotFound, "", "", ""},
+		{"", http.StatusBadRequest, "", "", ""},
+	}
+	for i, tc := range tests {
+		rec := httptest.NewRecorder()
+		a.policy(rec, httptest.NewRequest(http.MethodGet, "/untangle/policy?client="+tc.client, nil))
+		if rec.Code != tc.expectedStatus {
+			t.Errorf("Test %d: expected status %d, got %d", i, tc.expectedStatus, rec.Code)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+
+		var res adminPolicy
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if res.Client != tc.expectedClient || res.Network != tc.expectedNetwork || res.Customer != tc.expectedCustomer {
+			t.Errorf("Test %d: expected client %s on %q of customer %s, got %+v", i, tc.expectedClient, tc.expectedNetwork, tc.expectedCustomer, res)
+		}
+		if res.Customer == "a" && (res.Version != 3 || res.Policy == nil || !reflect.DeepEqual(res.Policy.BlockDomains, []string{"blocked.example.com"}) ||
+			!reflect.DeepEqual(res.BlockCategories, []int{7})) {
+			t.Errorf("Test %d: expected version 3 of the policy of customer a, got %+v", i, res)
+		}
+	}
+}
+
+func TestAdminLookup(t *testing.T) {
+	ut, cleanup := adminUntangle(t)
+	defer cleanup()
+	a := newAdmin("", ut)
+
+	tests := []struct {
+		body             string
+		expectedStatus   int
+		expectedAction   string
+		expectedReason   string
+		expectedCategory []int
+	}{
+		{`{"client": "10.240.0.1", "qname": "www.example.org"}`, http.StatusOK, "block", "category 7", []int{7}},
+		{`{"client": "00:11:22:AA:BB:CC", "qname": "WWW.example.org."}`, http.StatusOK, "block", "category 7", []int{7}},
+		{`{"client": "10.240.0.1", "qname": "www.blocked.example.com"}`, http.StatusOK, "block", "domain blocked.example.com", nil},
+		{`{"client": "10.240.0.1", "qname": "allowed.example.com"}`, http.StatusOK, "allow", "", nil},
+		{`{"client": "10.2.0.1", "qname": "www.example.org"}`, http.StatusOK, "allow", "", []int{7}},
+		{`{"client": "192.0.2.1", "qname": "www.example.org"}`, http.StatusNotFound, "", "", nil},
+		{`{"client": "10.240.0.1"}`, http.StatusBadRequest, "", "", nil},
+		{`{"client": "10.240.0.1", "qname": "bad..name"}`, http.StatusBadRequest, "", "", nil},
+		{`client=10.240.0.1`, http.StatusBadRequest, "", "", nil},
+	}
+	for i, tc := range tests {
+		rec := httptest.NewRecorder()
+		a.lookup(rec, httptest.NewRequest(http.MethodPost, "/untangle/lookup", strings.NewReader(tc.body)))
+		if rec.Code != tc.expectedStatus {
+			t.Errorf("Test %d: expected status %d, got %d: %s", i, tc.expectedStatus, rec.Code, rec.Body)
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+
+		var res adminDecision
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if res.Action != tc.expectedAction || res.Reason != tc.expectedReason || !reflect.DeepEqual(res.Categories, tc.expectedCategory) {
+			t.Errorf("Test %d: expected %s for %q with categories %v, got %+v", i, tc.expectedAction, tc.expectedReason, tc.expectedCategory, res)
+		}
+		if res.Categories != nil && (res.Reputation == nil || *res.Reputation != 80) {
+			t.Errorf("Test %d: expected reputation 80, got %+v", i, res)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	a.lookup(rec, httptest.NewRequest(http.MethodGet, "/untangle/lookup", nil))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("Expected GET to be refused, got %d", rec.Code)
+	}
+}
+
+func TestAdminLookupMatchesServeDNS(t *testing.T) {
+	ut, cleanup := adminUntangle(t)
+	defer cleanup()
+	ut.Next = rpzUpstream()
+	ut.rpz = []*rpzZone{loadRPZ(t, "rpz.example.org", `$ORIGIN rpz.example.org.
+@ 300 IN SOA ns.rpz.example.org. admin.rpz.example.org. 1 3600 600 86400 60
+bad.example.com 300 IN CNAME .
+ok.example.com 300 IN CNAME rpz-passthru.
+32.1.0.240.10.rpz-client-ip 300 IN CNAME *.
+`)}
+	a := newAdmin("", ut)
+
+	tests := []struct {
+		client string // of both the admin lookup and the query
+		qname  string
+	}{
+		{"10.240.0.1", "www.example.org."},
+		{"10.240.0.1", "blocked.example.com."},
+		{"10.240.0.1", "allowed.example.com."},
+		{"10.240.0.1", "bad.example.com."},
+		{"10.3.0.1", "bad.example.com."},
+		{"10.3.0.1", "ok.example.com."},
+		{"10.3.0.1", "www.example.org."},
+	}
+	for i, tc := range tests {
+		rec := httptest.NewRecorder()
+		body := `{"client": "` + tc.client + `", "qname": "` + tc.qname + `"}`
+		a.lookup(rec, httptest.NewRequest(http.MethodPost, "/untangle/lookup", strings.NewReader(body)))
+		var res adminDecision
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeA)
+		ctx := context.WithValue(context.TODO(), decisionKey{}, new(decision))
+		ut.ServeDNS(ctx, dnstest.NewRecorder(&test.ResponseWriter{RemoteIP: tc.client}), m)
+		d := decisionFrom(ctx)
+
+		if res.Action != d.action || res.Reason != d.reason.text {
+			t.Errorf("Test %d: expected %s for %q like the query, got %s for %q", i, d.action, d.reason.text, res.Action, res.Reason)
+		}
+	}
+}
+
+func TestAdminLookupSource(t *testing.T) {
+	ut, cleanup := adminUntangle(t)
+	defer cleanup()
+	ut.rpz = []*rpzZone{loadRPZ(t, "rpz.example.org", `$ORIGIN rpz.example.org.
+@ 300 IN SOA ns.rpz.example.org. admin.rpz.example.org. 1 3600 600 86400 60
+32.1.0.240.10.rpz-client-ip 300 IN CNAME .
+`)}
+	a := newAdmin("", ut)
+
+	tests := []struct {
+		body           string
+		expectedReason string
+	}{
+		// a device is matched on the address of the forwarder it queries through
+		{`{"client": "00:11:22:aa:bb:cc", "qname": "www.example.org", "source": "10.240.0.1"}`, "rpz rpz.example.org 32.1.0.240.10.rpz-client-ip"},
+		{`{"client": "00:11:22:aa:bb:cc", "qname": "www.example.org"}`, "category 7"},
+		// an address is matched itself
+		{`{"client": "10.240.0.1", "qname": "www.example.org", "source": "10.240.0.2"}`, "rpz rpz.example.org 32.1.0.240.10.rpz-client-ip"},
+		{`{"client": "10.240.0.2", "qname": "www.example.org", "source": "10.240.0.1"}`, "category 7"},
+	}
+	for i, tc := range tests {
+		rec := httptest.NewRecorder()
+		a.lookup(rec, httptest.NewRequest(http.MethodPost, "/untangle/lookup", strings.NewReader(tc.body)))
+		var res adminDecision
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatalf("Test %d: %v", i, err)
+		}
+		if res.Reason != tc.expectedReason {
+			t.Errorf("Test %d: expected reason %q, got %q", i, tc.expectedReason, res.Reason)
+		}
+	}
+}
+
+func TestAdminLookupFailed(t *testing.T) {
+	ut, cleanup := adminUntangle(t)
+	defer cleanup()
+	ut.pool.Stop()
+	ut.pool = newPool(downDaemon(), 1)
+	ut.onError = errorBlock
+	a := newAdmin("", ut)
+
+	rec := httptest.NewRecorder()
+	a.lookup(rec, httptest.NewRequest(http.MethodPost, "/untangle/lookup", strings.NewReader(`{"client": "10.240.0.1", "qname": "www.example.org"}`)))
+
+	var res adminDecision
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Action != "block" || res.Reason != lookupFailedReason.text || res.Error == "" {
+		t.Errorf("Expected the lookup failure to block, got %+v", res)
+	}
+}
+
+func TestAdminCustomers(t *testing.T) {
+	ut, cleanup := adminUntangle(t)
+	defer cleanup()
+	a := newAdmin("127.0.0.1:0", ut)
+	if err := a.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Stop()
+
+	resp, err := http.Get("http://" + a.ln.Addr().String() + "/untangle/customers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	var customers []adminCustomer
+	if err := json.NewDecoder(resp.Body).Decode(&customers); err != nil {
+		t.Fatal(err)
+	}
+	if len(customers) != 2 {
+		t.Fatalf("Expected 2 customers, got %+v", customers)
+	}
+	if c := customers[0]; c.Customer != "a" || c.Version != 3 || c.Policies != 1 || !strings.HasSuffix(c.File, "a.json") {
+		t.Errorf("Expected version 3 of customer a with 1 policy, got %+v", c)
+	}
+	if c := customers[1]; c.Customer != "b" || c.Version != 1 || c.Policies != 2 {
+		t.Errorf("Expected version 1 of customer b with 2 policies, got %+v", c)
+	}
+}
+
+func TestAdminPurge(t *testing.T) {
+	ut := &Untangle{}
+	a := newAdmin("", ut)
+
+	rec := httptest.NewRecorder()
+	a.purge(rec, httptest.NewRequest(http.MethodDelete, "/untangle/cache?name=www.example.org", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d without a cache, got %d", http.StatusNotFound, rec.Code)
+	}
+
+	ut.cache = newVerdictCache()
+	ut.cache.init()
+	now := time.Now()
+	ut.cache.add("www.example.org.", &Response{Reputation: 80}, now)
+	ut.cache.add("example.org.", &Response{Reputation: 80}, now)
+
+	rec = httptest.NewRecorder()
+	a.purge(rec, httptest.NewRequest(http.MethodDelete, "/untangle/cache?name=WWW.example.org", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("Expected status %d, got %d", http.StatusNoContent, rec.Code)
+	}
+	if _, ok := ut.cache.get("www.example.org.", now); ok {
+		t.Errorf("Expected www.example.org to be purged")
+	}
+	if _, ok := ut.cache.get("example.org.", now); !ok {
+		t.Errorf("Expected example.org to stay cached")
+	}
+
+	rec = httptest.NewRecorder()
+	a.purge(rec, httptest.NewRequest(http.MethodDelete, "/untangle/cache", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected status %d without a name, got %d", http.StatusBadRequest, rec.Code)
+	}
+}
@@ -0,0 +1,99 @@
+/*
+ * batch.go
+ * This is the daemon lookup batching for the Untangle DNS filter proxy
+ * The classifiers take a list of names, so during a burst of queries the
+ * lookups for different names that arrive within a short window are sent
+ * to the classifier together, for the daemon in a single command.
+ */
+
+package untangle
+
+import (
+	"sync"
+	"time"
+)
+
+// batcher collects lookups for a short window and sends them to the daemon
+// in one command.
+type batcher struct {
+	window time.Duration
+	max    int
+	send   func(urls []string) ([]*Response, error)
+
+	mu      sync.Mutex
+	pending []*batchCall
+	timer   *time.Timer
+}
+
+// batchCall is a lookup waiting for its batch to be sent.
+type batchCall struct {
+	url      string
+	done     chan struct{}
+	response *Response
+	err      error
+}
+
+func newBatcher(window time.Duration, max int, send func(urls []string) ([]*Response, error)) *batcher {
+	return &batcher{window: window, max: max, send: send}
+}
+
+// lookup adds url to the current batch and waits for the daemon response.
+func (b *batcher) lookup(url string) (*Response, error) {
+	call := &batchCall{url: url, done: make(chan struct{})}
+
+	b.mu.Lock()
+	b.pending = append(b.pending, call)
+	switch {
+	case len(b.pending) >= b.max:
+		batch := b.take()
+		b.mu.Unlock()
+		b.flush(batch)
+	case len(b.pending) == 1:
+		b.timer = time.AfterFunc(b.window, func() {
+			b.mu.Lock()
+			batch := b.take()
+			b.mu.Unlock()
+			b.flush(batch)
+		})
+		b.mu.Unlock()
+	default:
+		b.mu.Unlock()
+	}
+
+	<-call.done
+	return call.response, call.err
+}
+
+// take removes the pending lookups, b.mu must be held.
+func (b *batcher) take() []*batchCall {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batch := b.pending
+	b.pending = nil
+	return batch
+}
+
+// flush sends batch to the classifier and hands every lookup its response.
+func (b *batcher) flush(batch []*batchCall) {
+	if len(batch) == 0 {
+		return
+	}
+	urls := make([]string, len(batch))
+	for i, call := range batch {
+		urls[i] = call.url
+	}
+
+	responses, err := b.send(urls)
+	for i, call := range batch {
+		if err != nil {
+			call.err = err
+		} else {
+			call.response = responses[i]
+		}
+		close(call.done)
+	}
+}
+
+const defaultBatchMax = 50
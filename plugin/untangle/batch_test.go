@@ -0,0 +1,98 @@
+package untangle
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/singleflight"
+)
+
+func TestBatchLookups(t *testing.T) {
+	d := newFakeDaemon(t, echoDaemon)
+	defer d.Close()
+
+	ut := &Untangle{pool: newPool(d.Addr(), 1)}
+	defer ut.pool.Stop()
+	ut.batch = newBatcher(50*time.Millisecond, 10, ut.classify)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			r, err := ut.filterLookup(name)
+			if err != nil || r == nil || r.Url != name {
+				errs <- fmt.Errorf("expected the response for %s, got %v %v", name, r, err)
+			}
+		}(fmt.Sprintf("host%d.example.org.", i))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// the tenth lookup fills the batch, so the window doesn't have to pass
+	if x := atomic.LoadInt32(&d.queries); x != 1 {
+		t.Errorf("Expected 1 daemon command, got %d", x)
+	}
+}
+
+func TestBatchMatchesByUrl(t *testing.T) {
+	// the daemon only knows about the second url
+	ln := rawDaemon(t, `[{"url": "b.example.org", "reputation": 10}]`)
+	defer ln.Close()
+
+	ut := &Untangle{pool: newPool(ln.Addr().String(), 1)}
+	defer ut.pool.Stop()
+	b := newBatcher(time.Millisecond, 2, ut.classify)
+
+	var wg sync.WaitGroup
+	results := make([]*Response, 2)
+	for i, name := range []string{"a.example.org.", "b.example.org."} {
+		wg.Add(1)
+		go func(i int, name string) {
+			defer wg.Done()
+			results[i], _ = b.lookup(name)
+		}(i, name)
+	}
+	wg.Wait()
+
+	if results[0] != nil {
+		t.Errorf("Expected no response for a.example.org., got %v", results[0])
+	}
+	if results[1] == nil || results[1].Reputation != 10 {
+		t.Errorf("Expected the response for b.example.org., got %v", results[1])
+	}
+}
+
+func TestCoalescedLookup(t *testing.T) {
+	d := newFakeDaemon(t, func(url string) Response {
+		time.Sleep(50 * time.Millisecond)
+		return echoDaemon(url)
+	})
+	defer d.Close()
+
+	ut := &Untangle{pool: newPool(d.Addr(), 4), inflight: new(singleflight.Group)}
+	defer ut.pool.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if r, err := ut.lookup("example.org."); err != nil || r == nil {
+				t.Errorf("Expected a response, got %v %v", r, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if x := atomic.LoadInt32(&d.queries); x != 1 {
+		t.Errorf("Expected concurrent lookups to share 1 daemon command, got %d", x)
+	}
+}
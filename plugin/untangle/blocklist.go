@@ -0,0 +1,297 @@
+/*
+ * blocklist.go
+ * This is the blocklist support for the Untangle DNS filter proxy
+ * A blocklist is a list of domains read from a local file or an HTTP URL
+ * and refreshed periodically. Each list is a pseudo category, so policies
+ * block the names on a list the same way they block daemon categories.
+ * Three formats are understood, and may be mixed in one list:
+ *
+ *	0.0.0.0 ads.example.com     # hosts file, blocks only the names listed
+ *	tracker.example.com         # a domain per line, also blocks the names below it
+ *	||metrics.example.com^      # Adblock, also blocks the names below it
+ */
+
+package untangle
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// blocklistCategoryBase is added to the position of a blocklist in the
+	// Corefile to get its pseudo category, well away from the daemon ones.
+	blocklistCategoryBase = 1000
+
+	defaultBlocklistRefresh = time.Hour
+	defaultBlocklistTimeout = 30 * time.Second
+
+	// maxBlocklistSize is the largest blocklist we download.
+	maxBlocklistSize = 64 << 20
+)
+
+// blocklist is a named list of blocked domains.
+type blocklist struct {
+	name     string
+	source   string // file path or http(s) URL
+	category int    // the pseudo category of the list
+	client   *http.Client
+	refresher
+
+	sync.RWMutex // protects set
+	set          *suffixSet
+
+	etag string // only used by fetch
+}
+
+func newBlocklist(name, source string, category int) *blocklist {
+	bl := &blocklist{
+		name:     name,
+		source:   source,
+		category: category,
+		client:   &http.Client{Timeout: defaultBlocklistTimeout},
+	}
+	bl.refresher = refresher{refresh: defaultBlocklistRefresh, reload: bl.load}
+	return bl
+}
+
+// isURL reports if source is an http or https URL rather than a file path.
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// match reports if name is on the list.
+func (bl *blocklist) match(name string) bool {
+	bl.RLock()
+	set := bl.set
+	bl.RUnlock()
+	return set != nil && set.match(name)
+}
+
+// load reads the list again if it has changed.
+func (bl *blocklist) load() error {
+	var (
+		set *suffixSet
+		err error
+	)
+	if isURL(bl.source) {
+		set, err = bl.fetch()
+	} else {
+		set, err = bl.read()
+	}
+	if err != nil {
+		BlocklistLoadCount.WithLabelValues(bl.name, "failure").Inc()
+		return fmt.Errorf("blocklist %s: %v", bl.name, err)
+	}
+	if set == nil {
+		// unchanged
+		return nil
+	}
+	BlocklistLoadCount.WithLabelValues(bl.name, "success").Inc()
+	BlocklistEntries.WithLabelValues(bl.name).Set(float64(len(set.entries)))
+	log.Infof("Loaded %d domains for blocklist %s from %s\n", len(set.entries), bl.name, bl.source)
+
+	bl.Lock()
+	bl.set = set
+	bl.Unlock()
+	return nil
+}
+
+// read parses the list file if its modification time or size changed.
+func (bl *blocklist) read() (*suffixSet, error) {
+	var set *suffixSet
+	_, err := bl.readFile(bl.source, bl.set != nil, func(r io.Reader) (err error) {
+		set, err = parseBlocklist(r)
+		return err
+	})
+	return set, err
+}
+
+// fetch downloads the list, unless the server says our copy is current.
+func (bl *blocklist) fetch() (*suffixSet, error) {
+	req, err := http.NewRequest(http.MethodGet, bl.source, nil)
+	if err != nil {
+		return nil, err
+	}
+	if bl.set != nil && bl.etag != "" {
+		req.Header.Set("If-None-Match", bl.etag)
+	}
+
+	resp, err := bl.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return nil, nil
+	case http.StatusOK:
+	default:
+		return nil, fmt.Errorf("%s returned %s", bl.source, resp.Status)
+	}
+
+	set, err := parseBlocklist(io.LimitReader(resp.Body, maxBlocklistSize))
+	if err != nil {
+		return nil, err
+	}
+	bl.etag = resp.Header.Get("ETag")
+	return set, nil
+}
+
+// parseBlocklist reads a list in any of the supported formats. Lines that
+// are not understood, such as Adblock rules with options, are skipped.
+func parseBlocklist(r io.Reader) (*suffixSet, error) {
+	var entries []suffixEntry
+	add := func(name string, exact bool) {
+		name = strings.ToLower(dns.Fqdn(name))
+		// skip the local names found in hosts files, other Adblock rules and
+		// anything that is not a domain below a top level domain
+		if _, ok := dns.IsDomainName(name); !ok || strings.ContainsAny(name, "|^$@/*") ||
+			dns.CountLabel(name) < 2 || name == "localhost.localdomain." {
+			return
+		}
+		entries = append(entries, suffixEntry{key: reverseLabels(name), exact: exact})
+	}
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "||") {
+			rule := line[2:]
+			i := strings.IndexByte(rule, '^')
+			if i < 0 {
+				continue
+			}
+			if opts := rule[i+1:]; opts != "" && opts != "$important" {
+				continue
+			}
+			add(rule[:i], false)
+			continue
+		}
+
+		// a comment starts after white space, other uses of # are Adblock
+		// element hiding rules such as example.com##.banner
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			if line[i-1] != ' ' && line[i-1] != '\t' {
+				continue
+			}
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case net.ParseIP(fields[0]) != nil:
+			for _, name := range fields[1:] {
+				add(name, true)
+			}
+		case len(fields) == 1:
+			add(fields[0], false)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return newSuffixSet(entries), nil
+}
+
+// suffixSet is a sorted set of domains with their labels reversed, so
+// www.example.com is stored as com.example.www. A name matches a domain
+// when the reversed domain is a prefix of the reversed name that ends at a
+// label boundary, which takes one binary search per label of the name.
+type suffixSet struct {
+	entries []suffixEntry
+}
+
+type suffixEntry struct {
+	key   string
+	exact bool // only the domain itself matches, not the names below it
+}
+
+func newSuffixSet(entries []suffixEntry) *suffixSet {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].key != entries[j].key {
+			return entries[i].key < entries[j].key
+		}
+		// of a domain listed both ways the one covering the names below it
+		// sorts first and is kept
+		return !entries[i].exact && entries[j].exact
+	})
+
+	// remove the duplicates in place
+	n := 0
+	for _, e := range entries {
+		if n > 0 && entries[n-1].key == e.key {
+			continue
+		}
+		entries[n] = e
+		n++
+	}
+	return &suffixSet{entries: entries[:n:n]}
+}
+
+// match reports if name or one of its parents is in the set.
+func (s *suffixSet) match(name string) bool {
+	key := reverseLabels(strings.ToLower(dns.Fqdn(name)))
+	for end := 0; end < len(key); end++ {
+		if key[end] != '.' {
+			continue
+		}
+		prefix := key[:end+1]
+		i := sort.Search(len(s.entries), func(i int) bool { return s.entries[i].key >= prefix })
+		if i < len(s.entries) && s.entries[i].key == prefix && (len(prefix) == len(key) || !s.entries[i].exact) {
+			return true
+		}
+	}
+	return false
+}
+
+// reverseLabels returns the fully qualified name with its labels reversed.
+func reverseLabels(name string) string {
+	labels := dns.SplitDomainName(name)
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+	return strings.Join(labels, ".") + "."
+}
+
+// checkLists reports if the policy blocks name because it is on one of the
+// blocklists. The lists know nothing about reputation, only their pseudo
+// categories are checked.
+func (ut *Untangle) checkLists(name, client string, policy *policyHolder, now time.Time) (blockReason, bool) {
+	if len(policy.listCategories) == 0 {
+		return blockReason{}, false
+	}
+
+	filter := &Response{Url: name, Reputation: 100}
+	for _, bl := range ut.blocklists {
+		if bl.match(name) {
+			filter.Cats = append(filter.Cats, Category{Catid: bl.category})
+		}
+	}
+	if len(filter.Cats) == 0 {
+		return blockReason{}, false
+	}
+
+	reason, blocked := checkPolicy(name, client, policy, filter, now)
+	if !blocked {
+		return blockReason{}, false
+	}
+	bl := ut.blocklists[reason.category-blocklistCategoryBase-1]
+	return blockReason{kind: "blocklist", category: reason.category, text: "blocklist " + bl.name}, true
+}
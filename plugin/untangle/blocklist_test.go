@@ -0,0 +1,215 @@
+package untangle
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+const testBlocklist = `# hosts
+127.0.0.1 localhost
+0.0.0.0 ads.example.com banner.example.com # inline comment
+::1 ip6-localhost
+
+! adblock
+[Adblock Plus 2.0]
+||tracker.example.net^
+||metrics.example.org^$important
+||cosmetic.example.org^$third-party
+@@||allowed.example.org^
+example.com##.banner
+
+# domains
+Malware.Example.
+badsite.example
+`
+
+func TestParseBlocklist(t *testing.T) {
+	set, err := parseBlocklist(strings.NewReader(testBlocklist))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"ads.example.com.", true},
+		{"x.ads.example.com.", false}, // hosts entries only match themselves
+		{"banner.example.com.", true},
+		{"example.com.", false},
+		{"localhost.", false},
+		{"tracker.example.net.", true},
+		{"a.b.tracker.example.net.", true},
+		{"example.net.", false},
+		{"metrics.example.org.", true},
+		{"cosmetic.example.org.", false},
+		{"allowed.example.org.", false},
+		{"malware.example.", true},
+		{"www.MALWARE.example.", true},
+		{"badsite.example", true},
+		{"notbadsite.example.", false},
+		{"site.example.", false},
+	}
+	for i, tc := range tests {
+		if got := set.match(tc.name); got != tc.expected {
+			t.Errorf("Test %d: expected match %v for %s, got %v", i, tc.expected, tc.name, got)
+		}
+	}
+	if len(set.entries) != 6 {
+		t.Errorf("Expected 6 domains, got %d", len(set.entries))
+	}
+}
+
+func TestSuffixSetDuplicates(t *testing.T) {
+	set, _ := parseBlocklist(strings.NewReader("0.0.0.0 example.com\nexample.com\n||example.com^\n"))
+	if len(set.entries) != 1 {
+		t.Fatalf("Expected 1 domain, got %d", len(set.entries))
+	}
+	// the entry covering the names below it wins
+	if !set.match("www.example.com.") {
+		t.Errorf("Expected www.example.com to match")
+	}
+}
+
+func TestBlocklistFetch(t *testing.T) {
+	var requests, notModified int32
+	content := "||ads.example.com^\n"
+	etag := `"v1"`
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(&notModified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(content))
+	}))
+	defer ts.Close()
+
+	bl := newBlocklist("ads", ts.URL, blocklistCategoryBase+1)
+	if err := bl.load(); err != nil {
+		t.Fatal(err)
+	}
+	if !bl.match("ads.example.com.") {
+		t.Errorf("Expected ads.example.com to be on the list")
+	}
+
+	// an unchanged list is not downloaded again
+	if err := bl.load(); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 || notModified != 1 {
+		t.Errorf("Expected 2 requests of which 1 not modified, got %d and %d", requests, notModified)
+	}
+	if !bl.match("ads.example.com.") {
+		t.Errorf("Expected ads.example.com to stay on the list")
+	}
+
+	content, etag = "||tracker.example.com^\n", `"v2"`
+	if err := bl.load(); err != nil {
+		t.Fatal(err)
+	}
+	if bl.match("ads.example.com.") || !bl.match("tracker.example.com.") {
+		t.Errorf("Expected the updated list to be loaded")
+	}
+
+	// a failed download keeps the list we have
+	ts.Close()
+	if err := bl.load(); err == nil {
+		t.Errorf("Expected an error for a failed download")
+	}
+	if !bl.match("tracker.example.com.") {
+		t.Errorf("Expected the last list to be kept")
+	}
+}
+
+func TestBlocklistFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("ads.example.com\n")
+	f.Close()
+
+	bl := newBlocklist("ads", f.Name(), blocklistCategoryBase+1)
+	bl.refresh = 10 * time.Millisecond
+	bl.Start()
+	defer bl.Stop()
+
+	if err := ioutil.WriteFile(f.Name(), []byte("ads.example.com\ntracker.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) && !bl.match("tracker.example.com.") {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !bl.match("ads.example.com.") || !bl.match("tracker.example.com.") {
+		t.Errorf("Expected the updated list file to be loaded")
+	}
+}
+
+func TestBlocklistPolicy(t *testing.T) {
+	ads := newBlocklist("ads", "", blocklistCategoryBase+1)
+	ads.set, _ = parseBlocklist(strings.NewReader("ads.example.com\n"))
+	malware := newBlocklist("malware", "", blocklistCategoryBase+2)
+	malware.set, _ = parseBlocklist(strings.NewReader("malware.example.com\nads.example.com\n"))
+
+	tests := []struct {
+		lists          []int
+		qname          string
+		expectedRcode  int
+		expectedReason string
+	}{
+		{[]int{blocklistCategoryBase + 2}, "www.malware.example.com.", dns.RcodeNameError, "blocklist malware"},
+		{[]int{blocklistCategoryBase + 2}, "ads.example.com.", dns.RcodeNameError, "blocklist malware"},
+		{[]int{blocklistCategoryBase + 1}, "ads.example.com.", dns.RcodeNameError, "blocklist ads"},
+		{[]int{blocklistCategoryBase + 1}, "malware.example.com.", dns.RcodeRefused, ""},
+		{nil, "malware.example.com.", dns.RcodeRefused, ""},
+	}
+
+	for i, tc := range tests {
+		ut := &Untangle{
+			Next:       test.NextHandler(dns.RcodeRefused, nil),
+			blocklists: []*blocklist{ads, malware},
+			policies: singlePolicy(t, "10.240.0.0/16", &policyHolder{
+				action:         blockNxdomain,
+				listCategories: tc.lists,
+				// a schedule doesn't turn the blocklists off
+				schedules: []*schedule{{days: [7]bool{true, true, true, true, true, true, true}, loc: time.UTC}},
+			}),
+			onError: errorAllow,
+			pool:    newPool(downDaemon(), 1),
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		ctx := context.WithValue(context.TODO(), decisionKey{}, new(decision))
+		rcode, _ := ut.ServeDNS(ctx, rec, m)
+		ut.pool.Stop()
+
+		if rec.Msg != nil {
+			rcode = rec.Msg.Rcode
+		}
+		if rcode != tc.expectedRcode {
+			t.Errorf("Test %d: expected rcode %d, got %d", i, tc.expectedRcode, rcode)
+		}
+		if d := decisionFrom(ctx); d.reason.text != tc.expectedReason {
+			t.Errorf("Test %d: expected reason %q, got %q", i, tc.expectedReason, d.reason.text)
+		}
+	}
+}
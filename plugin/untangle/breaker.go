@@ -0,0 +1,78 @@
+/*
+ * breaker.go
+ * This is the daemon circuit breaker for the Untangle DNS filter proxy
+ * When the daemon fails several lookups in a row we stop asking it for a
+ * while so a dead daemon doesn't add a timeout to every query. After the
+ * cooldown a single lookup is let through to see if it has recovered.
+ */
+
+package untangle
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("filter daemon circuit open")
+
+// breaker is a consecutive failure circuit breaker.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	sync.Mutex
+	fails     int
+	openUntil time.Time
+	probing   bool
+
+	// Testing.
+	now func() time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow reports if a lookup may be sent to the daemon. Once the cooldown has
+// passed only one probe lookup is allowed until it reports back.
+func (b *breaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	if b.fails < b.threshold {
+		return true
+	}
+	if b.probing || b.now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+// success closes the circuit.
+func (b *breaker) success() {
+	b.Lock()
+	b.fails = 0
+	b.probing = false
+	b.Unlock()
+}
+
+// failure records a failed lookup and opens the circuit once the threshold is reached.
+func (b *breaker) failure() {
+	b.Lock()
+	b.fails++
+	b.probing = false
+	if b.threshold > 0 && b.fails >= b.threshold {
+		b.openUntil = b.now().Add(b.cooldown)
+	}
+	b.Unlock()
+}
+
+const (
+	defaultBreakerFails    = 5
+	defaultBreakerCooldown = 10 * time.Second
+)
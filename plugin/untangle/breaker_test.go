@@ -0,0 +1,51 @@
+package untangle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	b := newBreaker(2, 10*time.Second)
+	b.now = func() time.Time { return now }
+
+	b.failure()
+	if !b.allow() {
+		t.Fatalf("Expected circuit to be closed after 1 failure")
+	}
+	b.failure()
+	if b.allow() {
+		t.Fatalf("Expected circuit to be open after 2 failures")
+	}
+
+	now = now.Add(11 * time.Second)
+	if !b.allow() {
+		t.Fatalf("Expected a probe to be allowed after the cooldown")
+	}
+	if b.allow() {
+		t.Fatalf("Expected only one probe while half open")
+	}
+
+	b.failure()
+	if b.allow() {
+		t.Fatalf("Expected circuit to open again after a failed probe")
+	}
+
+	now = now.Add(11 * time.Second)
+	b.allow()
+	b.success()
+	if !b.allow() || !b.allow() {
+		t.Errorf("Expected circuit to be closed after a successful probe")
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	b := newBreaker(0, time.Second)
+	for i := 0; i < 10; i++ {
+		b.failure()
+	}
+	if !b.allow() {
+		t.Errorf("Expected a disabled breaker to always allow")
+	}
+}
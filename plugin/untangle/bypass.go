@@ -0,0 +1,105 @@
+/*
+ * bypass.go
+ * This is the encrypted DNS bypass blocking for the Untangle DNS filter proxy
+ * Browsers turn off their own DNS over HTTPS, and keep using us, when a
+ * canary domain doesn't resolve. Clients that hardcode a public DoH or DoT
+ * resolver still need its host name, so we don't resolve those either.
+ */
+
+package untangle
+
+import (
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// bypassCanaries are the canary domains answered with NXDOMAIN.
+var bypassCanaries = mustDomainList(
+	"use-application-dns.net", // Firefox
+	"mask.icloud.com",         // iCloud Private Relay
+	"mask-h2.icloud.com",
+)
+
+// bypassResolvers are the host names of well known public DoH and DoT
+// resolvers, answered with NODATA. Each name also covers the names below it.
+var bypassResolvers = mustDomainList(
+	"dns.google",
+	"dns64.dns.google",
+	"8888.google",
+	"cloudflare-dns.com",
+	"one.one.one.one",
+	"dns.quad9.net",
+	"dns9.quad9.net",
+	"dns10.quad9.net",
+	"dns11.quad9.net",
+	"doh.opendns.com",
+	"doh.familyshield.opendns.com",
+	"doh.umbrella.com",
+	"dns.adguard.com",
+	"dns.adguard-dns.com",
+	"family.adguard-dns.com",
+	"unfiltered.adguard-dns.com",
+	"dns.nextdns.io",
+	"doh.cleanbrowsing.org",
+	"doh.dns.sb",
+	"dns.alidns.com",
+	"doh.pub",
+	"dns.mullvad.net",
+	"doh.mullvad.net",
+	"dns.controld.com",
+	"freedns.controld.com",
+	"doh.libredns.gr",
+	"dns.digitale-gesellschaft.ch",
+	"doh.xfinity.com",
+	"doh.applied-privacy.net",
+	"dns.switch.ch",
+	"ordns.he.net",
+	"dns0.eu",
+	"odvr.nic.cz",
+	"doh.ffmuc.net",
+)
+
+func mustDomainList(names ...string) domainList {
+	var l domainList
+	for _, name := range names {
+		d, err := parseDomain(name)
+		if err != nil {
+			panic(err)
+		}
+		l = append(l, d)
+	}
+	return l
+}
+
+// checkBypass reports if name is used to get around our filtering, and if so
+// the rcode to answer it with and why.
+func checkBypass(name string) (blockReason, int, bool) {
+	if d, ok := bypassCanaries.match(name); ok {
+		log.Debugf("Domain %s is a DNS bypass canary\n", name)
+		return blockReason{kind: "bypass", text: "dns bypass canary " + strings.TrimSuffix(d, ".")}, dns.RcodeNameError, true
+	}
+	if d, ok := bypassResolvers.match(name); ok {
+		log.Debugf("Domain %s is an encrypted DNS resolver\n", name)
+		return blockReason{kind: "bypass", text: "encrypted dns resolver " + strings.TrimSuffix(d, ".")}, dns.RcodeSuccess, true
+	}
+	return blockReason{}, 0, false
+}
+
+// blockBypass answers a bypass query with rcode and no records, whatever the
+// block action of the policy is; a block page is of no use to a browser
+// probing for a canary or looking up its resolver.
+func (ut *Untangle) blockBypass(w dns.ResponseWriter, r *dns.Msg, state request.Request, policy *policyHolder, d *decision, rcode int) (int, error) {
+	a := new(dns.Msg)
+	a.SetReply(r)
+	a.Authoritative = true
+	a.Rcode = rcode
+
+	explain(a, state, policy.explain, d.reason)
+
+	w.WriteMsg(a)
+	return 0, nil
+}
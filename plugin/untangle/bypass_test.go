@@ -0,0 +1,60 @@
+package untangle
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestBlockBypass(t *testing.T) {
+	allow, _ := parseDomain("dns.quad9.net")
+	tests := []struct {
+		bypass        bool
+		qname         string
+		qtype         uint16
+		expectedRcode int
+		expectedCount int // answers
+	}{
+		{true, "use-application-dns.net.", dns.TypeA, dns.RcodeNameError, 0},
+		{true, "mask-h2.icloud.com.", dns.TypeAAAA, dns.RcodeNameError, 0},
+		{true, "dns.google.", dns.TypeA, dns.RcodeSuccess, 0},
+		{true, "mozilla.cloudflare-dns.com.", dns.TypeTXT, dns.RcodeSuccess, 0},
+		{true, "dns.quad9.net.", dns.TypeA, dns.RcodeRefused, 0}, // allowed by the policy
+		{true, "www.example.org.", dns.TypeA, dns.RcodeRefused, 0},
+		{false, "use-application-dns.net.", dns.TypeA, dns.RcodeRefused, 0},
+		{false, "dns.google.", dns.TypeA, dns.RcodeRefused, 0},
+	}
+
+	for i, tc := range tests {
+		ut := &Untangle{
+			Next: test.NextHandler(dns.RcodeRefused, nil),
+			policies: singlePolicy(t, "10.240.0.0/16", &policyHolder{
+				redirect4:    []byte{192, 0, 2, 1},
+				blockBypass:  tc.bypass,
+				allowDomains: domainList{allow},
+			}),
+			onError: errorAllow,
+			pool:    newPool(downDaemon(), 1),
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, _ := ut.ServeDNS(context.TODO(), rec, m)
+		ut.pool.Stop()
+
+		if rec.Msg != nil {
+			rcode = rec.Msg.Rcode
+			if len(rec.Msg.Answer) != tc.expectedCount {
+				t.Errorf("Test %d: expected %d answers, got %v", i, tc.expectedCount, rec.Msg.Answer)
+			}
+		}
+		if rcode != tc.expectedRcode {
+			t.Errorf("Test %d: expected rcode %d for %s, got %d", i, tc.expectedRcode, tc.qname, rcode)
+		}
+	}
+}
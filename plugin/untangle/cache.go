@@ -0,0 +1,116 @@
+/*
+ * cache.go
+ * This is the verdict cache for the Untangle DNS filter proxy
+ * The reputation and categories of a name rarely change, so we remember
+ * the daemon response for each query name and only go back to the daemon
+ * when the entry expires. Popular names are prefetched before they expire.
+ */
+
+package untangle
+
+import (
+	"math"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/cache/freq"
+	"github.com/coredns/coredns/plugin/pkg/cache"
+)
+
+// verdictCache holds daemon responses keyed by query name.
+type verdictCache struct {
+	cache *cache.Cache
+	cap   int
+	ttl   time.Duration
+	nttl  time.Duration
+
+	// Prefetch.
+	prefetch   int
+	duration   time.Duration
+	percentage int
+
+	// Testing.
+	now func() time.Time
+}
+
+// verdict is a cached daemon response. A nil response records that the
+// daemon had nothing for the name.
+type verdict struct {
+	name     string
+	response *Response
+	stored   time.Time
+	ttl      time.Duration
+
+	*freq.Freq
+}
+
+func newVerdictCache() *verdictCache {
+	return &verdictCache{
+		cap:        defaultCacheCap,
+		ttl:        defaultCacheTTL,
+		nttl:       defaultCacheNTTL,
+		duration:   1 * time.Minute,
+		percentage: 10,
+		now:        time.Now,
+	}
+}
+
+// init allocates the cache once the capacity is known.
+func (vc *verdictCache) init() { vc.cache = cache.New(vc.cap) }
+
+// get returns the verdict for name if there is one that has not expired.
+func (vc *verdictCache) get(name string, now time.Time) (*verdict, bool) {
+	name = strings.ToLower(name)
+	i, ok := vc.cache.Get(cache.Hash([]byte(name)))
+	if !ok {
+		return nil, false
+	}
+	v := i.(*verdict)
+	if v.name != name || v.remaining(now) <= 0 {
+		return nil, false
+	}
+	return v, true
+}
+
+// add stores the response for name, a nil response is negatively cached.
+func (vc *verdictCache) add(name string, response *Response, now time.Time) *verdict {
+	name = strings.ToLower(name)
+	v := &verdict{name: name, response: response, stored: now, ttl: vc.ttl, Freq: freq.New(now)}
+	if response == nil {
+		v.ttl = vc.nttl
+	}
+	if v.ttl <= 0 {
+		return v
+	}
+	vc.cache.Add(cache.Hash([]byte(name)), v)
+	return v
+}
+
+// remove drops any verdict for name.
+func (vc *verdictCache) remove(name string) {
+	vc.cache.Remove(cache.Hash([]byte(strings.ToLower(name))))
+}
+
+// Len returns the number of cached verdicts.
+func (vc *verdictCache) Len() int { return vc.cache.Len() }
+
+// shouldPrefetch records a hit on v and reports if v is popular enough and
+// close enough to expiring to be refreshed in the background.
+func (vc *verdictCache) shouldPrefetch(v *verdict, now time.Time) bool {
+	if vc.prefetch <= 0 {
+		return false
+	}
+	v.Freq.Update(vc.duration, now)
+	threshold := time.Duration(math.Ceil(float64(vc.percentage) / 100 * float64(v.ttl)))
+	return v.Freq.Hits() >= vc.prefetch && v.remaining(now) <= threshold
+}
+
+func (v *verdict) remaining(now time.Time) time.Duration {
+	return v.ttl - now.Sub(v.stored)
+}
+
+const (
+	defaultCacheCap  = 10000
+	defaultCacheTTL  = 1 * time.Hour
+	defaultCacheNTTL = 5 * time.Minute
+)
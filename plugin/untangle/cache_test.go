@@ -0,0 +1,78 @@
+package untangle
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestVerdictCache(t *testing.T) {
+	vc := newVerdictCache()
+	vc.init()
+	now := time.Now()
+
+	vc.add("Example.org.", &Response{Url: "example.org.", Reputation: 10}, now)
+	vc.add("nothing.example.org.", nil, now)
+
+	if v, ok := vc.get("example.org.", now.Add(time.Minute)); !ok || v.response.Reputation != 10 {
+		t.Errorf("Expected cached verdict for example.org.")
+	}
+	if _, ok := vc.get("example.org.", now.Add(defaultCacheTTL+time.Second)); ok {
+		t.Errorf("Expected verdict for example.org. to expire")
+	}
+	if v, ok := vc.get("nothing.example.org.", now.Add(time.Minute)); !ok || v.response != nil {
+		t.Errorf("Expected negative verdict for nothing.example.org.")
+	}
+	if _, ok := vc.get("nothing.example.org.", now.Add(defaultCacheNTTL+time.Second)); ok {
+		t.Errorf("Expected negative verdict to expire after the negative ttl")
+	}
+	if _, ok := vc.get("other.example.org.", now); ok {
+		t.Errorf("Expected no verdict for other.example.org.")
+	}
+
+	vc.remove("EXAMPLE.org.")
+	if _, ok := vc.get("example.org.", now); ok {
+		t.Errorf("Expected verdict for example.org. to be removed")
+	}
+}
+
+func TestVerdictCachePrefetch(t *testing.T) {
+	vc := newVerdictCache()
+	vc.prefetch = 2
+	vc.init()
+	now := time.Now()
+
+	v := vc.add("example.org.", &Response{}, now)
+	if vc.shouldPrefetch(v, now) {
+		t.Errorf("Expected no prefetch for a fresh entry")
+	}
+	late := now.Add(defaultCacheTTL - time.Minute)
+	vc.shouldPrefetch(v, late.Add(-time.Second))
+	if !vc.shouldPrefetch(v, late) {
+		t.Errorf("Expected prefetch for a popular entry about to expire")
+	}
+}
+
+func TestLookupCached(t *testing.T) {
+	d := newFakeDaemon(t, func(url string) Response {
+		if url == "unknown.example.org." {
+			return Response{}
+		}
+		return echoDaemon(url)
+	})
+	defer d.Close()
+
+	ut := &Untangle{pool: newPool(d.Addr(), 1), cache: newVerdictCache()}
+	ut.cache.init()
+	defer ut.pool.Stop()
+
+	for i := 0; i < 3; i++ {
+		r, err := ut.lookup("example.org.")
+		if err != nil || r == nil || r.Url != "example.org." {
+			t.Fatalf("Expected response for example.org., got %v, %v", r, err)
+		}
+	}
+	if x := atomic.LoadInt32(&d.queries); x != 1 {
+		t.Errorf("Expected 1 daemon query, got %d", x)
+	}
+}
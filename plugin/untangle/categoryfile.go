@@ -0,0 +1,90 @@
+/*
+ * categoryfile.go
+ * This is the category file classifier for the Untangle DNS filter proxy
+ * The reputation and categories of names are read from a local file, so
+ * the filter can run without the Brightcloud daemon. Each line holds a
+ * name, its reputation and optionally a comma separated list of categories:
+ *
+ *	# name reputation categories
+ *	example.com 80 7,11
+ */
+
+package untangle
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// categoryFile is a classifier that looks names up in a category file.
+type categoryFile struct {
+	path  string
+	names map[string]*Response
+}
+
+// newCategoryFile reads the category file at path.
+func newCategoryFile(path string) (*categoryFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cf := &categoryFile{path: path, names: make(map[string]*Response)}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: too many fields", path, n)
+		}
+		if _, ok := dns.IsDomainName(fields[0]); !ok {
+			return nil, fmt.Errorf("%s:%d: invalid domain name %q", path, n, fields[0])
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("%s:%d: missing reputation", path, n)
+		}
+		reputation, err := strconv.Atoi(fields[1])
+		if err != nil || reputation < 0 || reputation > 100 {
+			return nil, fmt.Errorf("%s:%d: invalid reputation %q", path, n, fields[1])
+		}
+
+		name := dns.Fqdn(strings.ToLower(fields[0]))
+		response := &Response{Url: name, Reputation: reputation, Source: "file"}
+		if len(fields) == 3 {
+			for _, c := range strings.Split(fields[2], ",") {
+				id, err := strconv.Atoi(c)
+				if err != nil || id <= 0 {
+					return nil, fmt.Errorf("%s:%d: invalid category %q", path, n, c)
+				}
+				response.Cats = append(response.Cats, Category{Catid: id, Conf: 100})
+			}
+		}
+		cf.names[name] = response
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cf, nil
+}
+
+// Classify implements the Classifier interface.
+func (cf *categoryFile) Classify(ctx context.Context, names []string) ([]*Response, error) {
+	responses := make([]*Response, len(names))
+	for i, name := range names {
+		responses[i] = cf.names[dns.Fqdn(strings.ToLower(name))]
+	}
+	return responses, nil
+}
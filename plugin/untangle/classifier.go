@@ -0,0 +1,82 @@
+/*
+ * classifier.go
+ * This is the classifier interface for the Untangle DNS filter proxy
+ * A classifier returns the reputation and categories of names. The
+ * Brightcloud daemon is the default classifier; a local category file and
+ * an HTTP JSON API can be used instead, for instance in a lab without the
+ * daemon.
+ */
+
+package untangle
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// Classifier looks up the reputation and categories of names.
+type Classifier interface {
+	// Classify returns one response per name, in the order of names. The
+	// response is nil when the classifier knows nothing about the name.
+	Classify(ctx context.Context, names []string) ([]*Response, error)
+}
+
+// brightcloud is the classifier that asks the Brightcloud daemon.
+type brightcloud struct {
+	pool *pool
+}
+
+// Classify implements the Classifier interface.
+func (bc *brightcloud) Classify(ctx context.Context, names []string) ([]*Response, error) {
+	var response []Response
+
+	command, err := json.Marshal(getInfoCommand{GetInfo: getInfo{Urls: names, A1cat: 1, Reputation: 1}})
+	if err != nil {
+		log.Errorf("Error encoding daemon command: %v\n", err)
+		return nil, err
+	}
+	command = append(command, '\r', '\n')
+	log.Debugf("DAEMON COMMAND: %s\n", command)
+
+	// send the command over one of the pooled daemon connections
+	message, err := bc.pool.Exchange(command)
+	if err != nil {
+		log.Errorf("Error querying daemon %s: %v\n", bc.pool.addr, err)
+		return nil, err
+	}
+
+	log.Debugf("DAEMON RESPONSE: %s\n", message)
+	if err := json.Unmarshal(message, &response); err != nil {
+		log.Errorf("Error decoding daemon response: %v\n", err)
+		return nil, err
+	}
+	return alignResponses(names, response), nil
+}
+
+// alignResponses returns the response for each of names. Responses are
+// expected in the order of names; if there isn't one response per name they
+// are matched by url instead.
+func alignResponses(names []string, responses []Response) []*Response {
+	aligned := make([]*Response, len(names))
+	for i, name := range names {
+		if len(responses) == len(names) {
+			aligned[i] = &responses[i]
+			continue
+		}
+		aligned[i] = findResponse(responses, name)
+	}
+	return aligned
+}
+
+// findResponse returns the response for url, if there is one.
+func findResponse(responses []Response, url string) *Response {
+	for i := range responses {
+		if strings.EqualFold(strings.TrimSuffix(responses[i].Url, "."), strings.TrimSuffix(url, ".")) {
+			return &responses[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package untangle
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCategoryFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untangle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "categories")
+	ioutil.WriteFile(path, []byte(`# name reputation categories
+Example.com 80 7,11
+bad.example.net. 10   # no categories
+`), 0644)
+
+	cf, err := newCategoryFile(path)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	responses, err := cf.Classify(context.TODO(), []string{"example.com.", "BAD.example.net.", "example.org."})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if r := responses[0]; r == nil || r.Reputation != 80 || len(r.Cats) != 2 || r.Cats[1].Catid != 11 {
+		t.Errorf("Expected example.com. with categories 7 and 11, got %v", r)
+	}
+	if r := responses[1]; r == nil || r.Reputation != 10 || len(r.Cats) != 0 {
+		t.Errorf("Expected bad.example.net. with reputation 10, got %v", r)
+	}
+	if responses[2] != nil {
+		t.Errorf("Expected nothing for example.org., got %v", responses[2])
+	}
+
+	for i, content := range []string{
+		"example.com\n",
+		"example.com 101\n",
+		"example.com 50 7,x\n",
+		"example.com 50 7 11\n",
+		"a..b 50\n",
+	} {
+		ioutil.WriteFile(path, []byte(content), 0644)
+		if _, err := newCategoryFile(path); err == nil || !strings.Contains(err.Error(), ":1:") {
+			t.Errorf("Test %d: expected an error for line 1, got %v", i, err)
+		}
+	}
+}
+
+func TestHTTPClassifier(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req httpClassifyRequest
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var responses []Response
+		for _, u := range req.Urls {
+			if u == "example.com." {
+				responses = append(responses, Response{Url: u, Reputation: 80, Cats: []Category{{Catid: 7}}})
+			}
+		}
+		json.NewEncoder(w).Encode(responses)
+	}))
+	defer s.Close()
+
+	hc := newHTTPClassifier(s.URL, time.Second)
+	responses, err := hc.Classify(context.TODO(), []string{"example.org.", "example.com."})
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if responses[0] != nil {
+		t.Errorf("Expected nothing for example.org., got %v", responses[0])
+	}
+	if r := responses[1]; r == nil || len(r.Cats) != 1 || r.Cats[0].Catid != 7 {
+		t.Errorf("Expected category 7 for example.com., got %v", r)
+	}
+
+	s.Config.Handler = http.NotFoundHandler()
+	if _, err := hc.Classify(context.TODO(), []string{"example.com."}); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Expected an error for a failed request, got %v", err)
+	}
+	if _, err := newHTTPClassifier("http://127.0.0.1:1", time.Second).Classify(context.TODO(), []string{"example.com."}); err == nil {
+		t.Errorf("Expected an error for an unreachable classifier")
+	}
+}
+
+func TestClassifierLookup(t *testing.T) {
+	ut := &Untangle{classifier: &categoryFile{names: map[string]*Response{
+		"example.com.": {Url: "example.com.", Reputation: 80, Cats: []Category{{Catid: 7}}},
+	}}}
+
+	if r, err := ut.lookup("Example.com."); err != nil || r == nil || r.Cats[0].Catid != 7 {
+		t.Errorf("Expected category 7 for example.com., got %v %v", r, err)
+	}
+	if r, err := ut.lookup("example.org."); err != nil || r != nil {
+		t.Errorf("Expected nothing for example.org., got %v %v", r, err)
+	}
+}
@@ -0,0 +1,241 @@
+/*
+ * events.go
+ * This is the decision event log for the Untangle DNS filter proxy
+ * Every allow and block decision can be written as a line of JSON to a
+ * file or a socket for our reporting pipeline. Files are rotated when they
+ * grow too large, and allowed queries can be sampled to reduce the volume.
+ */
+
+package untangle
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+)
+
+// event is a single line in the event log.
+type event struct {
+	Time       string `json:"time"`
+	Client     string `json:"client"`
+	Customer   string `json:"customer"`
+	Name       string `json:"qname"`
+	Type       string `json:"qtype"`
+	Reputation *int   `json:"reputation,omitempty"`
+	Categories []int  `json:"categories,omitempty"`
+	Action     string `json:"action"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// eventLog writes events to a file or socket. Events are queued and written
+// in the background; when the queue is full events are dropped rather than
+// holding up queries.
+type eventLog struct {
+	dest    string
+	maxSize int64 // rotate the file when it would grow beyond this, 0 to never rotate
+	keep    int   // number of rotated files kept
+	sample  int   // percentage of allowed queries written
+
+	queue chan []byte
+	stop  chan struct{}
+	done  chan struct{}
+
+	w    io.WriteCloser
+	size int64
+
+	// Testing.
+	now  func() time.Time
+	rand func(int) int
+}
+
+func newEventLog(dest string) *eventLog {
+	return &eventLog{
+		dest:   dest,
+		keep:   defaultEventKeep,
+		sample: 100,
+		now:    time.Now,
+		rand:   rand.Intn,
+	}
+}
+
+// Start starts writing queued events.
+func (el *eventLog) Start() {
+	el.queue = make(chan []byte, eventQueueSize)
+	el.stop = make(chan struct{})
+	el.done = make(chan struct{})
+	go el.run()
+}
+
+// Stop writes the queued events and closes the destination.
+func (el *eventLog) Stop() {
+	close(el.stop)
+	<-el.done
+}
+
+// record queues an event for the decision d about the query in state.
+func (el *eventLog) record(state request.Request, d *decision) {
+	if d.action == "allow" && el.sample < 100 && el.rand(100) >= el.sample {
+		return
+	}
+
+	e := event{
+		Time:     el.now().UTC().Format(time.RFC3339Nano),
+		Client:   d.client,
+		Customer: d.customer,
+		Name:     state.Name(),
+		Type:     state.Type(),
+		Action:   d.action,
+		Reason:   d.reason.text,
+	}
+	if d.filter != nil {
+		reputation := d.filter.Reputation
+		e.Reputation = &reputation
+		for _, c := range d.filter.Cats {
+			e.Categories = append(e.Categories, c.Catid)
+		}
+	}
+
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	select {
+	case el.queue <- append(buf, '\n'):
+	default:
+		EventDropCount.Inc()
+	}
+}
+
+func (el *eventLog) run() {
+	defer close(el.done)
+	for {
+		select {
+		case line := <-el.queue:
+			el.write(line)
+		case <-el.stop:
+			for {
+				select {
+				case line := <-el.queue:
+					el.write(line)
+				default:
+					if el.w != nil {
+						el.w.Close()
+					}
+					return
+				}
+			}
+		}
+	}
+}
+
+// write writes a line to the destination, opening or rotating it when needed.
+// A line that can't be written is dropped and the destination is reopened for
+// the next one.
+func (el *eventLog) write(line []byte) {
+	if el.w != nil && el.maxSize > 0 && el.size+int64(len(line)) > el.maxSize && isFile(el.dest) {
+		el.w.Close()
+		el.w = nil
+		el.rotate()
+	}
+	if el.w == nil {
+		if err := el.open(); err != nil {
+			log.Errorf("Error opening event log %s: %v\n", el.dest, err)
+			EventDropCount.Inc()
+			return
+		}
+	}
+	n, err := el.w.Write(line)
+	el.size += int64(n)
+	if err != nil {
+		log.Errorf("Error writing event log %s: %v\n", el.dest, err)
+		EventDropCount.Inc()
+		el.w.Close()
+		el.w = nil
+	}
+}
+
+// open opens the destination, a file path or a unix:, tcp: or udp: address.
+func (el *eventLog) open() error {
+	if network, addr, ok := splitSocket(el.dest); ok {
+		conn, err := net.DialTimeout(network, addr, defaultDialTimeout)
+		if err != nil {
+			return err
+		}
+		el.w, el.size = conn, 0
+		return nil
+	}
+
+	f, err := os.OpenFile(el.dest, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	el.w, el.size = f, info.Size()
+	return nil
+}
+
+// rotate moves the log file to dest.1, dest.1 to dest.2 and so on, keeping
+// at most keep old files.
+func (el *eventLog) rotate() {
+	if el.keep <= 0 {
+		os.Remove(el.dest)
+		return
+	}
+	os.Remove(fmt.Sprintf("%s.%d", el.dest, el.keep))
+	for i := el.keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", el.dest, i), fmt.Sprintf("%s.%d", el.dest, i+1))
+	}
+	if err := os.Rename(el.dest, el.dest+".1"); err != nil {
+		log.Errorf("Error rotating event log %s: %v\n", el.dest, err)
+	}
+}
+
+// splitSocket splits a socket destination such as unix:/run/events.sock or
+// udp:192.0.2.1:5140 into its network and address.
+func splitSocket(dest string) (network, addr string, ok bool) {
+	for _, network := range []string{"unix", "tcp", "udp"} {
+		if strings.HasPrefix(dest, network+":") {
+			return network, dest[len(network)+1:], true
+		}
+	}
+	return "", "", false
+}
+
+func isFile(dest string) bool {
+	_, _, ok := splitSocket(dest)
+	return !ok
+}
+
+// parseEventDest checks an event log destination.
+func parseEventDest(dest string) error {
+	network, addr, ok := splitSocket(dest)
+	if !ok {
+		return nil
+	}
+	if addr == "" {
+		return fmt.Errorf("missing %s address", network)
+	}
+	if network != "unix" {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	eventQueueSize   = 1024
+	defaultEventKeep = 3
+)
@@ -0,0 +1,119 @@
+package untangle
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func testRequest(name string, qtype uint16) request.Request {
+	m := new(dns.Msg)
+	m.SetQuestion(name, qtype)
+	return request.Request{W: &test.ResponseWriter{}, Req: m}
+}
+
+func TestEventLogFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untangle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.log")
+	el := newEventLog(path)
+	el.now = func() time.Time { return time.Date(2019, 11, 4, 9, 0, 0, 0, time.UTC) }
+	el.Start()
+
+	blocked := (&decision{customer: "a", client: "10.240.0.1", filter: &Response{Reputation: 30, Cats: []Category{{Catid: 7}, {Catid: 11}}}}).
+		blockedBy(blockReason{kind: "category", category: 7, text: "category 7"})
+	el.record(testRequest("example.org.", dns.TypeMX), blocked)
+	el.record(testRequest("example.net.", dns.TypeA), &decision{customer: "a", client: "10.240.0.1", action: "allow"})
+	el.Stop()
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"time":"2019-11-04T09:00:00Z","client":"10.240.0.1","customer":"a","qname":"example.org.","qtype":"MX","reputation":30,"categories":[7,11],"action":"block","reason":"category 7"}
+{"time":"2019-11-04T09:00:00Z","client":"10.240.0.1","customer":"a","qname":"example.net.","qtype":"A","action":"allow"}
+`
+	if string(buf) != expected {
+		t.Errorf("Expected events\n%s\ngot\n%s", expected, buf)
+	}
+}
+
+func TestEventLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untangle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "events.log")
+	el := newEventLog(path)
+	el.maxSize = 300
+	el.keep = 2
+	el.Start()
+	for i := 0; i < 10; i++ {
+		el.record(testRequest("example.org.", dns.TypeA), &decision{customer: "a", client: "10.240.0.1", action: "allow"})
+	}
+	el.Stop()
+
+	for _, name := range []string{"events.log", "events.log.1", "events.log.2"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Errorf("Expected %s to exist: %v", name, err)
+			continue
+		}
+		if info.Size() > el.maxSize {
+			t.Errorf("Expected %s to be at most %d bytes, got %d", name, el.maxSize, info.Size())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "events.log.3")); err == nil {
+		t.Errorf("Expected only 2 rotated files to be kept")
+	}
+}
+
+func TestEventLogSample(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	el := newEventLog("tcp:" + ln.Addr().String())
+	el.sample = 0
+	el.Start()
+	el.record(testRequest("example.net.", dns.TypeA), &decision{customer: "a", client: "10.240.0.1", action: "allow"})
+	el.record(testRequest("example.org.", dns.TypeA), (&decision{customer: "a", client: "10.240.0.1"}).blockedBy(blockReason{kind: "domain", text: "domain example.org"}))
+
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	el.Stop()
+
+	var e event
+	if err := json.Unmarshal(line, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Action != "block" || e.Name != "example.org." {
+		t.Errorf("Expected only the block event to be sent, got %s", line)
+	}
+}
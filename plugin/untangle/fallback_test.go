@@ -0,0 +1,125 @@
+package untangle
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+func TestParentDomain(t *testing.T) {
+	tests := []struct {
+		qname    string
+		expected string // empty when there is no parent to fall back to
+	}{
+		{"a.b.example.com.", "b.example.com."},
+		{"b.example.com.", "example.com."},
+		{"example.com.", ""},
+		{"com.", ""},
+		{"WWW.Example.co.uk.", "example.co.uk."},
+		{"example.co.uk.", ""},
+		{"co.uk.", ""},
+		{".", ""},
+		// answer addresses looked up by inspect_answers have no parent
+		{"1.2.3.4", ""},
+		{"1.2.3.4.", ""},
+		{"2001:db8::1", ""},
+	}
+
+	for i, tc := range tests {
+		parent, ok := parentDomain(tc.qname)
+		if ok != (tc.expected != "") || parent != tc.expected {
+			t.Errorf("Test %d: expected parent %q for %s, got %q", i, tc.expected, tc.qname, parent)
+		}
+	}
+}
+
+func TestParentFallback(t *testing.T) {
+	d := newFakeDaemon(t, func(url string) Response {
+		if url == "example.com." {
+			return Response{Url: url, Reputation: 80, Cats: []Category{{Catid: 7}}}
+		}
+		return Response{Url: url, Reputation: 60}
+	})
+	defer d.Close()
+
+	tests := []struct {
+		qname    string
+		fallback bool
+		expected int // category, 0 for none
+	}{
+		{"a.b.example.com.", false, 0},
+		{"a.b.example.com.", true, 7},
+		{"example.com.", true, 7},
+		{"www.example.org.", true, 0},
+	}
+
+	for i, tc := range tests {
+		ut := &Untangle{pool: newPool(d.Addr(), 1), parentFallback: tc.fallback}
+		r, err := ut.lookup(tc.qname)
+		ut.pool.Stop()
+		if err != nil || r == nil {
+			t.Errorf("Test %d: expected a response, got %v %v", i, r, err)
+			continue
+		}
+		got := 0
+		if len(r.Cats) > 0 {
+			got = r.Cats[0].Catid
+		}
+		if got != tc.expected {
+			t.Errorf("Test %d: expected category %d for %s, got %d", i, tc.expected, tc.qname, got)
+		}
+	}
+}
+
+// rawDaemon answers every command with reply.
+func rawDaemon(t *testing.T, reply string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					if _, err := r.ReadBytes('\n'); err != nil {
+						return
+					}
+					conn.Write([]byte(reply + "\n"))
+				}
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestMalformedResponses(t *testing.T) {
+	tests := []struct {
+		reply     string
+		shouldErr bool
+	}{
+		{`[]`, false},
+		{`null`, false},
+		{`[{"url": "example.org", "reputation": 80}]`, false},
+		{`{"error": "bad request"}`, true},
+		{`[{"url": "example.org", "cats": "7"}]`, true},
+		{`not json`, true},
+	}
+
+	for i, tc := range tests {
+		ln := rawDaemon(t, tc.reply)
+		ut := &Untangle{pool: newPool(ln.Addr().String(), 1), parentFallback: true}
+		_, err := ut.lookup("www.example.org.")
+		ut.pool.Stop()
+		ln.Close()
+
+		if tc.shouldErr != (err != nil) {
+			t.Errorf("Test %d: expected error %t for %s, got %v", i, tc.shouldErr, tc.reply, err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+/*
+ * httpclassifier.go
+ * This is the HTTP classifier for the Untangle DNS filter proxy
+ * The names are posted to a JSON API as {"urls": [...]}, which answers
+ * with the same list of results the Brightcloud daemon returns.
+ */
+
+package untangle
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// httpClassifier is a classifier that asks an HTTP JSON API.
+type httpClassifier struct {
+	url    string
+	client *http.Client
+}
+
+func newHTTPClassifier(url string, timeout time.Duration) *httpClassifier {
+	return &httpClassifier{url: url, client: &http.Client{Timeout: timeout}}
+}
+
+type httpClassifyRequest struct {
+	Urls []string `json:"urls"`
+}
+
+// Classify implements the Classifier interface.
+func (hc *httpClassifier) Classify(ctx context.Context, names []string) ([]*Response, error) {
+	body, err := json.Marshal(httpClassifyRequest{Urls: names})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, hc.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := hc.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("classifier %s returned %s", hc.url, resp.Status)
+	}
+
+	var responses []Response
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxClassifyResponse)).Decode(&responses); err != nil {
+		return nil, fmt.Errorf("classifier %s returned an invalid response: %v", hc.url, err)
+	}
+	return alignResponses(names, responses), nil
+}
+
+const maxClassifyResponse = 1 << 20
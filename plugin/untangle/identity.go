@@ -0,0 +1,113 @@
+/*
+ * identity.go
+ * This is the client identification for the Untangle DNS filter proxy
+ * Behind a NAT or relay forwarder every query arrives from the same
+ * address. Trusted forwarders may tell us who the real client is with the
+ * EDNS0 client subnet option, or with an EDNS0 option carrying the MAC
+ * address or ID of the device, as dnsmasq's add-mac does.
+ */
+
+package untangle
+
+import (
+	"net"
+	"strings"
+
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// identifyMethod is a way of finding out who the client is.
+type identifyMethod int
+
+const (
+	identifyECS identifyMethod = iota // EDNS0 client subnet
+	identifyMAC                       // EDNS0 option with a MAC address or device ID
+)
+
+// defaultMACOption is the EDNS0 option code dnsmasq's add-mac uses.
+const defaultMACOption = 65001
+
+// clientPolicy returns the policy for the client of state and the identity
+// of the client it was found for. Queries from trusted forwarders are
+// matched with the identify methods in order, the first one that finds a
+// policy wins; otherwise the source address is used.
+func (ut *Untangle) clientPolicy(state request.Request) (*policyHolder, string) {
+	if len(ut.identify) > 0 && ut.trusted(state.IP()) {
+		for _, method := range ut.identify {
+			var client string
+			var policy *policyHolder
+			switch method {
+			case identifyECS:
+				if ip := clientSubnet(state.Req); ip != nil {
+					client = ip.String()
+					policy = ut.policies.lookup(client)
+				}
+			case identifyMAC:
+				if id := deviceOption(state.Req, ut.macOption); id != "" {
+					client = id
+					policy = ut.policies.lookupDevice(id)
+				}
+			}
+			if policy != nil {
+				return policy, client
+			}
+		}
+	}
+	return ut.policies.lookup(state.IP()), state.IP()
+}
+
+// trusted reports if queries from addr may assert who the client is.
+func (ut *Untangle) trusted(addr string) bool {
+	ip := net.ParseIP(addr)
+	for _, n := range ut.trustedForwarders {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientSubnet returns the address in the EDNS0 client subnet option of r.
+func clientSubnet(r *dns.Msg) net.IP {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if e, ok := o.(*dns.EDNS0_SUBNET); ok && e.Address != nil {
+			return e.Address
+		}
+	}
+	return nil
+}
+
+// deviceOption returns the device MAC address or ID in the EDNS0 option
+// with code of r. Six bytes of data are a binary MAC address, anything
+// else is a MAC address or device ID as text.
+func deviceOption(r *dns.Msg, code uint16) string {
+	opt := r.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+	for _, o := range opt.Option {
+		e, ok := o.(*dns.EDNS0_LOCAL)
+		if !ok || e.Code != code || len(e.Data) == 0 {
+			continue
+		}
+		if len(e.Data) == 6 {
+			return net.HardwareAddr(e.Data).String()
+		}
+		return normalizeDevice(string(e.Data))
+	}
+	return ""
+}
+
+// normalizeDevice returns the canonical form of a MAC address or device ID.
+func normalizeDevice(s string) string {
+	if mac, err := net.ParseMAC(s); err == nil {
+		return mac.String()
+	}
+	return strings.ToLower(strings.TrimSpace(s))
+}
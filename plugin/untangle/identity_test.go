@@ -0,0 +1,65 @@
+package untangle
+
+import (
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+func TestClientPolicy(t *testing.T) {
+	ps := newPolicySet("")
+	site, _ := parsePrefix("10.240.0.0/16")
+	lan, _ := parsePrefix("192.168.1.0/24")
+	ps.table.insert(site, &policyHolder{customerId: "site"})
+	ps.table.insert(lan, &policyHolder{customerId: "lan"})
+	ps.devices["00:11:22:33:44:55"] = &policyHolder{customerId: "mac"}
+	ps.devices["kids-tablet"] = &policyHolder{customerId: "device"}
+
+	// test.ResponseWriter queries come from 10.240.0.1
+	trusted, _ := parsePrefix("10.240.0.1")
+	other, _ := parsePrefix("10.0.0.1")
+
+	ecs := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("192.168.1.0").To4()}
+	mac := &dns.EDNS0_LOCAL{Code: defaultMACOption, Data: []byte{0, 0x11, 0x22, 0x33, 0x44, 0x55}}
+	id := &dns.EDNS0_LOCAL{Code: defaultMACOption, Data: []byte("Kids-Tablet")}
+	unknown := &dns.EDNS0_LOCAL{Code: defaultMACOption, Data: []byte("laptop")}
+
+	tests := []struct {
+		identify         []identifyMethod
+		trusted          *net.IPNet
+		options          []dns.EDNS0
+		expectedCustomer string
+		expectedClient   string
+	}{
+		{nil, trusted, []dns.EDNS0{ecs}, "site", "10.240.0.1"},
+		{[]identifyMethod{identifyECS}, trusted, []dns.EDNS0{ecs}, "lan", "192.168.1.0"},
+		{[]identifyMethod{identifyECS}, other, []dns.EDNS0{ecs}, "site", "10.240.0.1"},
+		{[]identifyMethod{identifyECS}, trusted, nil, "site", "10.240.0.1"},
+		{[]identifyMethod{identifyMAC}, trusted, []dns.EDNS0{mac}, "mac", "00:11:22:33:44:55"},
+		{[]identifyMethod{identifyMAC}, trusted, []dns.EDNS0{id}, "device", "kids-tablet"},
+		{[]identifyMethod{identifyMAC, identifyECS}, trusted, []dns.EDNS0{unknown, ecs}, "lan", "192.168.1.0"},
+		{[]identifyMethod{identifyMAC, identifyECS}, trusted, []dns.EDNS0{ecs, mac}, "mac", "00:11:22:33:44:55"},
+		{[]identifyMethod{identifyMAC}, trusted, []dns.EDNS0{unknown}, "site", "10.240.0.1"},
+	}
+
+	for i, tc := range tests {
+		ut := &Untangle{policies: ps, identify: tc.identify, macOption: defaultMACOption, trustedForwarders: []*net.IPNet{tc.trusted}}
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		if tc.options != nil {
+			m.SetEdns0(4096, false)
+			opt := m.IsEdns0()
+			opt.Option = append(opt.Option, tc.options...)
+		}
+
+		policy, client := ut.clientPolicy(request.Request{W: &test.ResponseWriter{}, Req: m})
+		if policy == nil || policy.customerId != tc.expectedCustomer || client != tc.expectedClient {
+			t.Errorf("Test %d: expected %s for %s, got %+v for %s", i, tc.expectedCustomer, tc.expectedClient, policy, client)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * inspect.go
+ * This is the answer inspection for the Untangle DNS filter proxy
+ * A permitted name can CNAME to a blocked domain or resolve to an address
+ * with a bad reputation. When answer inspection is enabled we wrap the
+ * ResponseWriter, classify every CNAME target and address in the upstream
+ * answer, and block the whole answer if any of them violates the policy.
+ */
+
+package untangle
+
+import (
+	"strings"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+// ResponseWriter is a response writer that checks the answer against the
+// client policy before passing it on.
+type ResponseWriter struct {
+	dns.ResponseWriter
+	*Untangle
+	state    request.Request
+	policy   *policyHolder
+	decision *decision
+}
+
+// WriteMsg implements the dns.ResponseWriter interface.
+func (w *ResponseWriter) WriteMsg(res *dns.Msg) error {
+	if reason, blocked := w.inspect(res); blocked {
+		w.block(w.ResponseWriter, w.state.Req, w.state, w.policy, w.decision.blockedBy(reason))
+		return nil
+	}
+	return w.ResponseWriter.WriteMsg(res)
+}
+
+// Write implements the dns.ResponseWriter interface.
+func (w *ResponseWriter) Write(buf []byte) (int, error) {
+	log.Warning("Answer inspection called with Write: not inspecting reply")
+	return w.ResponseWriter.Write(buf)
+}
+
+// inspect looks up every CNAME target and address in the answer section of
+// res and reports if one of them is blocked by the policy. The targets and
+// addresses that aren't listed by the policy are looked up together. Names
+// and addresses the daemon can't be asked about are let through; the query
+// name itself has already been checked.
+func (w *ResponseWriter) inspect(res *dns.Msg) (blockReason, bool) {
+	seen := make(map[string]bool)
+	var hops []string
+	for _, rr := range res.Answer {
+		var hop string
+		switch rr := rr.(type) {
+		case *dns.CNAME:
+			hop = strings.ToLower(rr.Target)
+		case *dns.A:
+			hop = rr.A.String()
+		case *dns.AAAA:
+			hop = rr.AAAA.String()
+		default:
+			continue
+		}
+		if seen[hop] {
+			continue
+		}
+		seen[hop] = true
+
+		if reason, listed, blocked := checkDomains(hop, w.policy); listed {
+			if blocked {
+				return reason, true
+			}
+			continue
+		}
+		if reason, blocked := w.checkLists(hop, w.decision.client, w.policy, w.clock()); blocked {
+			reason.text = strings.TrimSuffix(hop, ".") + ": " + reason.text
+			return reason, true
+		}
+		hops = append(hops, hop)
+	}
+	if len(hops) == 0 {
+		return blockReason{}, false
+	}
+
+	filters, err := w.lookupAll(hops)
+	if err != nil {
+		log.Debugf("Answer lookup failed (%v) - Skipping what isn't cached\n", err)
+	}
+	for i, filter := range filters {
+		if filter == nil {
+			continue
+		}
+		if reason, blocked := checkPolicy(hops[i], w.decision.client, w.policy, filter, w.clock()); blocked {
+			reason.text = strings.TrimSuffix(hops[i], ".") + ": " + reason.text
+			return reason, true
+		}
+	}
+	return blockReason{}, false
+}
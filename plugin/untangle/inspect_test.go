@@ -0,0 +1,118 @@
+package untangle
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+// badDaemon puts names and addresses containing "bad" or ending in .66 in category 7.
+func badDaemon(url string) Response {
+	if strings.Contains(url, "bad") || strings.HasSuffix(url, ".66") {
+		return Response{Url: url, Reputation: 80, Cats: []Category{{Catid: 7, Conf: 90}}}
+	}
+	return Response{Url: url, Reputation: 80, Cats: []Category{{Catid: 1, Conf: 90}}}
+}
+
+// answerHandler answers every query with rrs.
+func answerHandler(rrs ...string) plugin.Handler {
+	return plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, s := range rrs {
+			rr, _ := dns.NewRR(s)
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+}
+
+func TestInspectAnswers(t *testing.T) {
+	d := newFakeDaemon(t, badDaemon)
+	defer d.Close()
+
+	tests := []struct {
+		inspect  bool
+		answer   []string
+		expected string // last answer, block page address when blocked
+	}{
+		{true, []string{"www.example.org. 300 IN CNAME cdn.example.net.", "cdn.example.net. 300 IN A 192.0.2.10"}, "192.0.2.10"},
+		{true, []string{"www.example.org. 300 IN CNAME cdn.bad.example.", "cdn.bad.example. 300 IN A 192.0.2.10"}, "192.0.2.53"},
+		{true, []string{"www.example.org. 300 IN A 192.0.2.66"}, "192.0.2.53"},
+		{false, []string{"www.example.org. 300 IN CNAME cdn.bad.example.", "cdn.bad.example. 300 IN A 192.0.2.10"}, "192.0.2.10"},
+	}
+
+	for i, tc := range tests {
+		ut := &Untangle{
+			Next:     answerHandler(tc.answer...),
+			pool:     newPool(d.Addr(), 1),
+			inspect:  tc.inspect,
+			policies: singlePolicy(t, "10.240.0.0/16", &policyHolder{blockCategories: []int{7}, redirect4: net.ParseIP("192.0.2.53")}),
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		ut.ServeDNS(context.TODO(), rec, m)
+		ut.pool.Stop()
+
+		if rec.Msg == nil || len(rec.Msg.Answer) == 0 {
+			t.Errorf("Test %d: expected an answer, got %v", i, rec.Msg)
+			continue
+		}
+		a, ok := rec.Msg.Answer[len(rec.Msg.Answer)-1].(*dns.A)
+		if !ok {
+			t.Errorf("Test %d: expected an A record, got %v", i, rec.Msg.Answer)
+			continue
+		}
+		if got := a.A.String(); got != tc.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, tc.expected, got)
+		}
+	}
+}
+
+// countingClassifier answers like badDaemon and records the names of each call.
+type countingClassifier struct {
+	calls [][]string
+}
+
+func (cc *countingClassifier) Classify(ctx context.Context, names []string) ([]*Response, error) {
+	cc.calls = append(cc.calls, names)
+	responses := make([]*Response, len(names))
+	for i, name := range names {
+		r := badDaemon(name)
+		responses[i] = &r
+	}
+	return responses, nil
+}
+
+func TestInspectAnswersOneLookup(t *testing.T) {
+	cc := new(countingClassifier)
+	ut := &Untangle{
+		Next:       answerHandler("www.example.org. 300 IN CNAME cdn.example.net.", "cdn.example.net. 300 IN A 192.0.2.10", "cdn.example.net. 300 IN A 192.0.2.66"),
+		classifier: cc,
+		inspect:    true,
+		policies:   singlePolicy(t, "10.240.0.0/16", &policyHolder{blockCategories: []int{7}, redirect4: net.ParseIP("192.0.2.53")}),
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	ut.ServeDNS(context.TODO(), rec, m)
+
+	// the query name, then the whole answer at once
+	if len(cc.calls) != 2 || strings.Join(cc.calls[1], " ") != "cdn.example.net. 192.0.2.10 192.0.2.66" {
+		t.Fatalf("Expected 2 lookups, the second for the whole answer, got %v", cc.calls)
+	}
+	if a, ok := rec.Msg.Answer[0].(*dns.A); !ok || a.A.String() != "192.0.2.53" {
+		t.Errorf("Expected the answer to be blocked, got %v", rec.Msg.Answer)
+	}
+}
@@ -0,0 +1,401 @@
+/*
+ * load.go
+ * This is the policy loading code for the Untangle DNS filter proxy
+ * Every server block reads the customer policy files from its own policy
+ * directory. Each file is loaded on its own; a file that can't be read or
+ * doesn't make sense is rejected and the last good version of it is kept.
+ */
+
+package untangle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+
+	"github.com/miekg/dns"
+)
+
+// defaultPolicyDir is where policy files are read from unless policy_dir is set.
+const defaultPolicyDir = "/etc/dnsproxy"
+
+// policySet holds the policies loaded from one policy directory.
+type policySet struct {
+	dir string
+
+	sync.RWMutex // protects table, devices, files and stop
+	table        *prefixTable
+	devices      map[string]*policyHolder
+	files        map[string]*loadedFile
+	stop         chan struct{}
+
+	// lists maps the blocklist names to their pseudo categories, it is set
+	// before the first load
+	lists map[string]int
+}
+
+// loadedFile is the last good configuration read from a policy file.
+type loadedFile struct {
+	config   *Configuration
+	policies []compiledPolicy
+}
+
+// compiledPolicy is a policy along with the networks and devices it applies to.
+type compiledPolicy struct {
+	networks []*net.IPNet
+	devices  []string
+	holder   *policyHolder
+}
+
+func newPolicySet(dir string) *policySet {
+	return &policySet{dir: dir, table: newPrefixTable(), devices: make(map[string]*policyHolder), files: make(map[string]*loadedFile)}
+}
+
+// lookup returns the policy for the client address or nil if there is none.
+func (ps *policySet) lookup(client string) *policyHolder {
+	ps.RLock()
+	defer ps.RUnlock()
+	return ps.table.lookup(net.ParseIP(client))
+}
+
+// lookupDevice returns the policy for the device MAC address or ID or nil if
+// there is none.
+func (ps *policySet) lookupDevice(id string) *policyHolder {
+	ps.RLock()
+	defer ps.RUnlock()
+	return ps.devices[id]
+}
+
+// load reads all policy files in the policy directory and replaces the
+// active policies. Files that fail to load keep their last good version,
+// the errors for them are returned. Queries being served while we load see
+// either the old or the new policies, never a mix.
+func (ps *policySet) load() []error {
+	// if the directory itself is gone we keep everything we have
+	if _, err := os.Stat(ps.dir); err != nil {
+		return []error{fmt.Errorf("policy directory %s: %v", ps.dir, err)}
+	}
+
+	paths, errs := policyFiles(ps.dir)
+
+	files := make(map[string]*loadedFile, len(paths))
+	for _, path := range paths {
+		lf, err := loadFile(path)
+		if err == nil {
+			err = ps.resolveLists(path, lf)
+		}
+		if err != nil {
+			PolicyLoadCount.WithLabelValues("failure").Inc()
+			errs = append(errs, err)
+			ps.RLock()
+			lf = ps.files[path]
+			ps.RUnlock()
+			if lf == nil {
+				continue
+			}
+		} else {
+			PolicyLoadCount.WithLabelValues("success").Inc()
+		}
+		files[path] = lf
+	}
+
+	table := buildTable(files)
+	devices := buildDevices(files)
+
+	ps.Lock()
+	old := ps.files
+	ps.files = files
+	ps.table = table
+	ps.devices = devices
+	ps.Unlock()
+
+	reportVersions(old, files)
+	return errs
+}
+
+// resolveLists sets the pseudo categories of the blocklists the policies in
+// lf refer to. Unknown blocklists are an error.
+func (ps *policySet) resolveLists(path string, lf *loadedFile) error {
+	var errs []error
+	for i, cp := range lf.policies {
+		for j, name := range cp.holder.blockLists {
+			category, ok := ps.lists[name]
+			if !ok {
+				errs = append(errs, fmt.Errorf("policies[%d].blockLists[%d]: unknown blocklist %q", i, j, name))
+				continue
+			}
+			cp.holder.listCategories = append(cp.holder.listCategories, category)
+		}
+	}
+	if len(errs) > 0 {
+		return &fileError{file: path, errs: errs}
+	}
+	return nil
+}
+
+// reportVersions logs the customer configurations that changed between old
+// and files and records the active version and number of policies of each
+// customer. Files are visited in lexical order, so when the policies of a
+// customer span several files the version of the last one is recorded, like
+// buildTable lets the later file win.
+func reportVersions(old, files map[string]*loadedFile) {
+	paths := make([]string, 0, len(files))
+	active := make(map[string]int)
+	for path, lf := range files {
+		paths = append(paths, path)
+		active[lf.config.CustomerId] += len(lf.config.Policies)
+	}
+	sort.Strings(paths)
+	for customer, n := range active {
+		PolicyCount.WithLabelValues(customer).Set(float64(n))
+	}
+
+	for _, path := range paths {
+		lf := files[path]
+		PolicyVersion.WithLabelValues(lf.config.CustomerId).Set(float64(lf.config.Version))
+
+		prev := old[path]
+		if prev == nil || prev.config.Version != lf.config.Version || prev.config.CustomerId != lf.config.CustomerId {
+			log.Infof("Loaded policy version %d for customer %s from %s\n", lf.config.Version, lf.config.CustomerId, path)
+		}
+	}
+	for path, lf := range old {
+		if _, ok := active[lf.config.CustomerId]; !ok {
+			log.Infof("Removed policy for customer %s from %s\n", lf.config.CustomerId, path)
+			PolicyVersion.DeleteLabelValues(lf.config.CustomerId)
+			PolicyCount.DeleteLabelValues(lf.config.CustomerId)
+		}
+	}
+}
+
+// policyFiles returns the policy files found under dir, in lexical order.
+func policyFiles(dir string) ([]string, []error) {
+	var (
+		files []string
+		errs  []error
+	)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("policy directory %s: %v", dir, err))
+			return nil
+		}
+		if !info.IsDir() && strings.HasSuffix(path, ".json") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, fmt.Errorf("policy directory %s: %v", dir, err))
+	}
+	return files, errs
+}
+
+// loadFile reads, validates and compiles a single policy file.
+func loadFile(path string) (*loadedFile, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, &fileError{file: path, errs: []error{err}}
+	}
+
+	config, errs := parseConfiguration(buf)
+	if len(errs) > 0 {
+		return nil, &fileError{file: path, errs: errs}
+	}
+
+	policies, errs := compileConfiguration(config)
+	if len(errs) > 0 {
+		return nil, &fileError{file: path, errs: errs}
+	}
+	return &loadedFile{config: config, policies: policies}, nil
+}
+
+// compileConfiguration turns the policies of a customer into policy holders.
+// It checks what the schema can't: that addresses and prefixes are valid
+// and of the right family.
+func compileConfiguration(config *Configuration) ([]compiledPolicy, []error) {
+	var (
+		policies []compiledPolicy
+		errs     []error
+	)
+
+	for i, policy := range config.Policies {
+		path := fmt.Sprintf("policies[%d]", i)
+		holder := &policyHolder{
+			customerId:        config.CustomerId,
+			version:           config.Version,
+			source:            &config.Policies[i],
+			minimumReputation: policy.BlockReputation,
+			blockBypass:       policy.BlockDnsBypass,
+		}
+		holder.blockLists = append(holder.blockLists, policy.BlockLists...)
+		holder.blockCategories = append(holder.blockCategories, policy.BlockCategories...)
+
+		var err error
+		if holder.onError, err = parseErrorAction(policy.OnError); err != nil {
+			errs = append(errs, fmt.Errorf("%s.onError: %v", path, err))
+		}
+		if holder.action, err = parseBlockAction(policy.BlockAction); err != nil {
+			errs = append(errs, fmt.Errorf("%s.blockAction: %v", path, err))
+		}
+		if holder.explain, err = parseExplainMode(policy.BlockExplain); err != nil {
+			errs = append(errs, fmt.Errorf("%s.blockExplain: %v", path, err))
+		}
+		if policy.BlockCname != "" {
+			if _, ok := dns.IsDomainName(policy.BlockCname); !ok {
+				errs = append(errs, fmt.Errorf("%s.blockCname: invalid domain name %q", path, policy.BlockCname))
+			} else {
+				holder.cname = dns.Fqdn(strings.ToLower(policy.BlockCname))
+			}
+		}
+		if holder.action == blockCname && policy.BlockCname == "" {
+			errs = append(errs, fmt.Errorf("%s.blockCname: required by blockAction %q", path, policy.BlockAction))
+		}
+		for _, list := range []struct {
+			name    string
+			domains []string
+			dst     *domainList
+		}{
+			{"allowDomains", policy.AllowDomains, &holder.allowDomains},
+			{"blockDomains", policy.BlockDomains, &holder.blockDomains},
+		} {
+			for j, domain := range list.domains {
+				d, err := parseDomain(domain)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s.%s[%d]: %v", path, list.name, j, err))
+					continue
+				}
+				*list.dst = append(*list.dst, d)
+			}
+		}
+		if policy.SafeSearch {
+			holder.safeSearch = safeAll
+			if len(policy.SafeSearchEngines) > 0 {
+				holder.safeSearch = 0
+			}
+			for j, engine := range policy.SafeSearchEngines {
+				e, err := parseSafeSearchEngine(engine)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s.safeSearchEngines[%d]: %v", path, j, err))
+				}
+				holder.safeSearch |= e
+			}
+			mode, err := parseYouTubeRestrict(policy.YoutubeRestrict)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s.youtubeRestrict: %v", path, err))
+			}
+			holder.safeSearch |= mode
+		}
+		for j, s := range policy.Schedules {
+			sc, scErrs := compileSchedule(fmt.Sprintf("%s.schedules[%d]", path, j), s)
+			errs = append(errs, scErrs...)
+			holder.schedules = append(holder.schedules, sc)
+		}
+
+		// the legacy redirectIp is used for the family it belongs to
+		if policy.RedirectIp != "" {
+			ip := net.ParseIP(policy.RedirectIp)
+			switch {
+			case ip == nil:
+				errs = append(errs, fmt.Errorf("%s.redirectIp: invalid address %q", path, policy.RedirectIp))
+			case ip.To4() != nil:
+				holder.redirect4 = ip.To4()
+			default:
+				holder.redirect6 = ip
+			}
+		}
+		if policy.RedirectIpv4 != "" {
+			ip := net.ParseIP(policy.RedirectIpv4)
+			if ip == nil || ip.To4() == nil {
+				errs = append(errs, fmt.Errorf("%s.redirectIpv4: invalid IPv4 address %q", path, policy.RedirectIpv4))
+			} else {
+				holder.redirect4 = ip.To4()
+			}
+		}
+		if policy.RedirectIpv6 != "" {
+			ip := net.ParseIP(policy.RedirectIpv6)
+			if ip == nil || ip.To4() != nil {
+				errs = append(errs, fmt.Errorf("%s.redirectIpv6: invalid IPv6 address %q", path, policy.RedirectIpv6))
+			} else {
+				holder.redirect6 = ip
+			}
+		}
+
+		// each address may be a single host or a CIDR prefix
+		cp := compiledPolicy{holder: holder}
+		for _, family := range []struct {
+			name  string
+			addrs []string
+			v4    bool
+		}{
+			{"ipv4Addrs", policy.Ipv4Addrs, true},
+			{"ipv6Addrs", policy.Ipv6Addrs, false},
+		} {
+			for j, addr := range family.addrs {
+				network, err := parsePrefix(addr)
+				if err != nil {
+					errs = append(errs, fmt.Errorf("%s.%s[%d]: %v", path, family.name, j, err))
+					continue
+				}
+				if (len(network.IP) == net.IPv4len) != family.v4 {
+					errs = append(errs, fmt.Errorf("%s.%s[%d]: %q is in the wrong address family", path, family.name, j, addr))
+					continue
+				}
+				cp.networks = append(cp.networks, network)
+			}
+		}
+		for _, device := range policy.Devices {
+			cp.devices = append(cp.devices, normalizeDevice(device))
+		}
+		policies = append(policies, cp)
+	}
+	return policies, errs
+}
+
+// buildTable indexes the policies of all files by network. Files are added
+// in lexical order, so when two files claim the same network the later one wins.
+func buildTable(files map[string]*loadedFile) *prefixTable {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	table := newPrefixTable()
+	for _, path := range paths {
+		for _, cp := range files[path].policies {
+			for _, network := range cp.networks {
+				holder := *cp.holder
+				holder.networkAddress = network.String()
+				table.insert(network, &holder)
+			}
+		}
+	}
+	return table
+}
+
+// buildDevices indexes the policies of all files by device. Files are added
+// in lexical order, so when two files claim the same device the later one wins.
+func buildDevices(files map[string]*loadedFile) map[string]*policyHolder {
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	devices := make(map[string]*policyHolder)
+	for _, path := range paths {
+		for _, cp := range files[path].policies {
+			for _, device := range cp.devices {
+				devices[device] = cp.holder
+			}
+		}
+	}
+	return devices
+}
@@ -0,0 +1,242 @@
+package untangle
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+const customerA = `{
+	"version": 1,
+	"customerId": "a",
+	"policies": [
+		{"ipv4Addrs": ["10.1.0.0/16"], "blockCategories": [1, 2], "blockReputation": 40, "redirectIp": "192.0.2.1"},
+		{"ipv6Addrs": ["2001:db8:a::/48"], "redirectIp": "2001:db8::1", "onError": "block"}
+	]
+}`
+
+const customerB = `{
+	"version": 3,
+	"customerId": "b",
+	"policies": [
+		{"ipv4Addrs": ["10.2.0.1"], "blockCategories": [5]}
+	]
+}`
+
+func writePolicy(t *testing.T, dir, name, content string) {
+	if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+		t.Fatalf("Failed to write %s: %v", name, err)
+	}
+}
+
+func TestPolicySetLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untangle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writePolicy(t, dir, "a.json", customerA)
+	writePolicy(t, dir, "b.json", customerB)
+	writePolicy(t, dir, "notes.txt", "not a policy")
+
+	ps := newPolicySet(dir)
+	if errs := ps.load(); len(errs) != 0 {
+		t.Fatalf("Expected no errors, got %v", errs)
+	}
+
+	p := ps.lookup("10.1.2.3")
+	if p == nil || p.customerId != "a" || p.minimumReputation != 40 || len(p.blockCategories) != 2 {
+		t.Errorf("Expected policy of customer a for 10.1.2.3, got %+v", p)
+	}
+	p = ps.lookup("2001:db8:a::1")
+	if p == nil || p.onError != errorBlock || p.redirect6.String() != "2001:db8::1" {
+		t.Errorf("Expected IPv6 policy of customer a, got %+v", p)
+	}
+	// fields of customer a must not leak into customer b
+	p = ps.lookup("10.2.0.1")
+	if p == nil || p.customerId != "b" || p.minimumReputation != 0 || p.redirect4 != nil || len(p.blockCategories) != 1 {
+		t.Errorf("Expected policy of customer b for 10.2.0.1, got %+v", p)
+	}
+	if p := ps.lookup("10.3.0.1"); p != nil {
+		t.Errorf("Expected no policy for 10.3.0.1, got %+v", p)
+	}
+	if v := testutil.ToFloat64(PolicyCount.WithLabelValues("a")); v != 2 {
+		t.Errorf("Expected 2 policies for customer a, got %v", v)
+	}
+}
+
+func TestPolicySetSplitCustomer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untangle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writePolicy(t, dir, "split-1.json", `{"version": 5, "customerId": "split", "policies": [{"ipv4Addrs": ["10.5.0.0/16"]}]}`)
+	writePolicy(t, dir, "split-2.json", `{"version": 2, "customerId": "split", "policies": [{"ipv4Addrs": ["10.6.0.0/16"]}]}`)
+
+	ps := newPolicySet(dir)
+	// the last file in lexical order wins on every load, whatever order the
+	// files are visited in
+	for i := 0; i < 10; i++ {
+		if errs := ps.load(); len(errs) != 0 {
+			t.Fatalf("Expected no errors, got %v", errs)
+		}
+		if v := testutil.ToFloat64(PolicyVersion.WithLabelValues("split")); v != 2 {
+			t.Fatalf("Expected version 2 for customer split, got %v", v)
+		}
+	}
+	if v := testutil.ToFloat64(PolicyCount.WithLabelValues("split")); v != 2 {
+		t.Errorf("Expected 2 policies for customer split, got %v", v)
+	}
+}
+
+func TestCompileSafeSearch(t *testing.T) {
+	tests := []struct {
+		policy   string
+		expected safeSearch
+	}{
+		{`{"safeSearchEngines": ["google"]}`, 0},
+		{`{"safeSearch": true}`, safeAll},
+		{`{"safeSearch": true, "safeSearchEngines": ["google", "youtube"], "youtubeRestrict": "moderate"}`, safeGoogle | safeYouTube | safeYouTubeModerate},
+	}
+
+	for i, tc := range tests {
+		config, errs := parseConfiguration([]byte(`{"version": 1, "customerId": "x", "policies": [` + tc.policy + `]}`))
+		if len(errs) > 0 {
+			t.Fatalf("Test %d: expected valid document, got %v", i, errs)
+		}
+		compiled, errs := compileConfiguration(config)
+		if len(errs) > 0 {
+			t.Fatalf("Test %d: expected no errors, got %v", i, errs)
+		}
+		if got := compiled[0].holder.safeSearch; got != tc.expected {
+			t.Errorf("Test %d: expected engines %b, got %b", i, tc.expected, got)
+		}
+	}
+}
+
+func TestPolicySetDevices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untangle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writePolicy(t, dir, "d.json", `{"version": 1, "customerId": "d", "policies": [
+		{"ipv4Addrs": ["10.5.0.0/16"]},
+		{"devices": ["00:11:22:AA:BB:CC", "Kids-Tablet"], "blockCategories": [11]}
+	]}`)
+
+	ps := newPolicySet(dir)
+	if errs := ps.load(); len(errs) != 0 {
+		t.Fatalf("Expected no errors, got %v", errs)
+	}
+	for _, id := range []string{"00:11:22:aa:bb:cc", "kids-tablet"} {
+		if p := ps.lookupDevice(id); p == nil || p.customerId != "d" || len(p.blockCategories) != 1 {
+			t.Errorf("Expected device policy of customer d for %s, got %+v", id, p)
+		}
+	}
+	if p := ps.lookupDevice("laptop"); p != nil {
+		t.Errorf("Expected no policy for unknown device, got %+v", p)
+	}
+
+	os.Remove(filepath.Join(dir, "d.json"))
+	ps.load()
+	if p := ps.lookupDevice("kids-tablet"); p != nil {
+		t.Errorf("Expected device policy of removed customer d to be gone, got %+v", p)
+	}
+}
+
+func TestPolicySetBlocklists(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untangle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writePolicy(t, dir, "e.json", `{"version": 1, "customerId": "e", "policies": [
+		{"ipv4Addrs": ["10.6.0.0/16"], "blockLists": ["malware", "ads"]}
+	]}`)
+	writePolicy(t, dir, "f.json", `{"version": 1, "customerId": "f", "policies": [
+		{"ipv4Addrs": ["10.7.0.0/16"]},
+		{"ipv4Addrs": ["10.8.0.0/16"], "blockLists": ["ads", "gambling"]}
+	]}`)
+
+	ps := newPolicySet(dir)
+	ps.lists = map[string]int{"ads": 1001, "malware": 1002}
+	errs := ps.load()
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "f.json") || !strings.Contains(errs[0].Error(), `policies[1].blockLists[1]: unknown blocklist "gambling"`) {
+		t.Errorf("Expected an error for the unknown blocklist in f.json, got %v", errs)
+	}
+	if p := ps.lookup("10.6.0.1"); p == nil || len(p.listCategories) != 2 || p.listCategories[0] != 1002 || p.listCategories[1] != 1001 {
+		t.Errorf("Expected the blocklists of customer e to be resolved, got %+v", p)
+	}
+	if p := ps.lookup("10.7.0.1"); p != nil {
+		t.Errorf("Expected no policy of customer f, got %+v", p)
+	}
+}
+
+func TestPolicySetKeepsLastGood(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untangle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writePolicy(t, dir, "a.json", customerA)
+	writePolicy(t, dir, "b.json", customerB)
+
+	ps := newPolicySet(dir)
+	if errs := ps.load(); len(errs) != 0 {
+		t.Fatalf("Expected no errors, got %v", errs)
+	}
+
+	// break both files, one with bad json and one with a bad address
+	writePolicy(t, dir, "a.json", `{"version": 2, "customerId": "a", "policies": [`)
+	writePolicy(t, dir, "b.json", strings.Replace(customerB, "10.2.0.1", "10.2.0.300", 1))
+	writePolicy(t, dir, "c.json", `{"version": 1, "customerId": "c", "policies": [{"ipv4Addrs": ["10.4.0.0/16"]}]}`)
+
+	errs := ps.load()
+	if len(errs) != 2 {
+		t.Fatalf("Expected 2 errors, got %v", errs)
+	}
+	for _, err := range errs {
+		if !strings.Contains(err.Error(), "a.json") && !strings.Contains(err.Error(), "b.json") {
+			t.Errorf("Expected error to name the bad file, got %v", err)
+		}
+	}
+
+	if p := ps.lookup("10.1.2.3"); p == nil || p.customerId != "a" {
+		t.Errorf("Expected last good policy of customer a to be kept")
+	}
+	if p := ps.lookup("10.2.0.1"); p == nil || p.customerId != "b" {
+		t.Errorf("Expected last good policy of customer b to be kept")
+	}
+	if p := ps.lookup("10.4.0.1"); p == nil || p.customerId != "c" {
+		t.Errorf("Expected new policy of customer c to be loaded")
+	}
+
+	// a removed file takes its policies with it
+	os.Remove(filepath.Join(dir, "a.json"))
+	ps.load()
+	if p := ps.lookup("10.1.2.3"); p != nil {
+		t.Errorf("Expected policy of removed customer a to be gone, got %+v", p)
+	}
+}
+
+func TestPolicySetMissingDir(t *testing.T) {
+	ps := newPolicySet("/nonexistent/untangle")
+	errs := ps.load()
+	if len(errs) == 0 {
+		t.Errorf("Expected an error for a missing policy directory")
+	}
+	if p := ps.lookup("10.1.2.3"); p != nil {
+		t.Errorf("Expected no policies, got %+v", p)
+	}
+}
@@ -0,0 +1,67 @@
+package untangle
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/request"
+)
+
+// decision is what we decided about a query. It is filled in by ServeDNS and
+// read by the metadata functions, the event log and the metrics.
+type decision struct {
+	customer string
+	client   string // the client identity the policy was found for
+	action   string // allow, block, rewrite or servfail
+	reason   blockReason
+	filter   *Response
+}
+
+// blockedBy records that the query is blocked for reason.
+func (d *decision) blockedBy(reason blockReason) *decision {
+	d.action = "block"
+	d.reason = reason
+	return d
+}
+
+type decisionKey struct{}
+
+// decisionFrom returns the decision the metadata functions were set up
+// with, or a new one when the metadata plugin is not used.
+func decisionFrom(ctx context.Context) *decision {
+	if d, ok := ctx.Value(decisionKey{}).(*decision); ok {
+		return d
+	}
+	return new(decision)
+}
+
+// Metadata implements the metadata.Provider interface.
+func (ut *Untangle) Metadata(ctx context.Context, state request.Request) context.Context {
+	d := new(decision)
+
+	metadata.SetValueFunc(ctx, "untangle/customer", func() string {
+		return d.customer
+	})
+
+	metadata.SetValueFunc(ctx, "untangle/client", func() string {
+		return d.client
+	})
+
+	metadata.SetValueFunc(ctx, "untangle/action", func() string {
+		return d.action
+	})
+
+	metadata.SetValueFunc(ctx, "untangle/reason", func() string {
+		return d.reason.kind
+	})
+
+	metadata.SetValueFunc(ctx, "untangle/category", func() string {
+		if d.reason.category == 0 {
+			return ""
+		}
+		return strconv.Itoa(d.reason.category)
+	})
+
+	return context.WithValue(ctx, decisionKey{}, d)
+}
@@ -0,0 +1,48 @@
+package untangle
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/metadata"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestMetadata(t *testing.T) {
+	d := newFakeDaemon(t, categoryDaemon)
+	defer d.Close()
+
+	ut := &Untangle{
+		Next:     test.NextHandler(dns.RcodeSuccess, nil),
+		pool:     newPool(d.Addr(), 1),
+		policies: singlePolicy(t, "10.240.0.0/16", &policyHolder{customerId: "a", blockCategories: []int{7}}),
+	}
+	defer ut.pool.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	w := &test.ResponseWriter{}
+
+	ctx := metadata.ContextWithMetadata(context.TODO())
+	ctx = ut.Metadata(ctx, testRequest("example.org.", dns.TypeA))
+	ut.ServeDNS(ctx, dnstest.NewRecorder(w), m)
+
+	for label, expected := range map[string]string{
+		"untangle/customer": "a",
+		"untangle/action":   "block",
+		"untangle/reason":   "category",
+		"untangle/category": "7",
+	} {
+		f := metadata.ValueFunc(ctx, label)
+		if f == nil {
+			t.Errorf("Expected metadata %s to be set", label)
+			continue
+		}
+		if got := f(); got != expected {
+			t.Errorf("Expected %s to be %q, got %q", label, expected, got)
+		}
+	}
+}
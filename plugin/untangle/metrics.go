@@ -0,0 +1,90 @@
+package untangle
+
+import (
+	"github.com/coredns/coredns/plugin"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Variables declared for monitoring.
+var (
+	QueryCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "untangle",
+		Name:      "query_count_total",
+		Help:      "Counter of queries checked against a policy per customer.",
+	}, []string{"customer"})
+	AllowCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "untangle",
+		Name:      "allow_count_total",
+		Help:      "Counter of queries allowed per customer.",
+	}, []string{"customer"})
+	BlockCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "untangle",
+		Name:      "block_count_total",
+		Help:      "Counter of queries blocked per customer, reason and category.",
+	}, []string{"customer", "reason", "category"})
+	LookupDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "untangle",
+		Name:      "lookup_duration_seconds",
+		Buckets:   plugin.TimeBuckets,
+		Help:      "Histogram of the time each daemon lookup took.",
+	})
+	LookupFailureCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "untangle",
+		Name:      "lookup_failure_count_total",
+		Help:      "Counter of daemon lookups that failed.",
+	})
+	EventDropCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "untangle",
+		Name:      "event_drop_count_total",
+		Help:      "Counter of events that could not be written to the event log.",
+	})
+	PolicyLoadCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "untangle",
+		Name:      "policy_load_count_total",
+		Help:      "Counter of policy file loads per result.",
+	}, []string{"result"})
+	PolicyCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "untangle",
+		Name:      "policies",
+		Help:      "Gauge of the policies loaded per customer.",
+	}, []string{"customer"})
+	PolicyVersion = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "untangle",
+		Name:      "policy_version",
+		Help:      "Version of the active policy configuration per customer.",
+	}, []string{"customer"})
+	BlocklistLoadCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "untangle",
+		Name:      "blocklist_load_count_total",
+		Help:      "Counter of blocklist loads per list and result.",
+	}, []string{"list", "result"})
+	BlocklistEntries = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "untangle",
+		Name:      "blocklist_entries",
+		Help:      "Number of domains on each blocklist.",
+	}, []string{"list"})
+	RPZLoadCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "untangle",
+		Name:      "rpz_load_count_total",
+		Help:      "Counter of response policy zone loads per zone and result.",
+	}, []string{"zone", "result"})
+	RPZRuleCount = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: "untangle",
+		Name:      "rpz_rules",
+		Help:      "Number of rules in each response policy zone.",
+	}, []string{"zone"})
+)
@@ -1,159 +1,253 @@
 /*
  * policy.go
  * This is the policy logic for the Untangle DNS filter proxy
- * Our checkPolicy function receives the query name, client address, and
- * the result we received from the brightcloud daemon. Our job is to
- * lookup and apply the policy configured for the client.
+ * Our checkPolicy function receives the query name, client address, the
+ * policy configured for the client, the result we received from the
+ * brightcloud daemon and the time. Our job is to apply the policy.
  */
 
 package untangle
 
 import (
-    "io/ioutil"
 	"fmt"
-	"sync"
+	"net"
+	"strings"
 	"time"
-    "os"
 
-    "strings"
-    "encoding/json"
-    "path/filepath"
 	"github.com/coredns/coredns/plugin/pkg/log"
+
+	"github.com/miekg/dns"
 )
 
+// Policy is the filtering policy for a set of client addresses.
 type Policy struct {
-    Ipv4Addrs []string
-    Ipv6Addrs []string
-    BlockCategories []int
-    BlockReputation int
-    RedirectIp string
+	Ipv4Addrs         []string   `json:"ipv4Addrs,omitempty"`
+	Ipv6Addrs         []string   `json:"ipv6Addrs,omitempty"`
+	Devices           []string   `json:"devices,omitempty"`
+	BlockCategories   []int      `json:"blockCategories,omitempty"`
+	BlockReputation   int        `json:"blockReputation,omitempty"`
+	RedirectIp        string     `json:"redirectIp,omitempty"` // deprecated, used when the family specific address is not set
+	RedirectIpv4      string     `json:"redirectIpv4,omitempty"`
+	RedirectIpv6      string     `json:"redirectIpv6,omitempty"`
+	OnError           string     `json:"onError,omitempty"`
+	BlockAction       string     `json:"blockAction,omitempty"`
+	BlockCname        string     `json:"blockCname,omitempty"`
+	BlockExplain      string     `json:"blockExplain,omitempty"`
+	AllowDomains      []string   `json:"allowDomains,omitempty"`
+	BlockDomains      []string   `json:"blockDomains,omitempty"`
+	Schedules         []Schedule `json:"schedules,omitempty"`
+	SafeSearch        bool       `json:"safeSearch,omitempty"`
+	SafeSearchEngines []string   `json:"safeSearchEngines,omitempty"`
+	YoutubeRestrict   string     `json:"youtubeRestrict,omitempty"`
+	BlockDnsBypass    bool       `json:"blockDnsBypass,omitempty"`
+	BlockLists        []string   `json:"blockLists,omitempty"`
 }
 
+// Configuration is the content of a customer policy file.
 type Configuration struct {
-//    Next          plugin.Handler
-    Version       int
-    CustomerId    string
-    Policies      []Policy
+	Version    int
+	CustomerId string
+	Policies   []Policy
 }
 
+// policyHolder is a policy compiled for one network of a customer.
 type policyHolder struct {
-	timestamp         time.Time
+	customerId        string
+	version           int     // of the customer configuration
+	source            *Policy // the policy as configured
 	networkAddress    string
 	minimumReputation int
 	blockCategories   []int
-	blockServer       string
+	redirect4         net.IP
+	redirect6         net.IP
+	onError           errorAction
+	action            blockAction
+	cname             string
+	explain           explainMode
+	allowDomains      domainList
+	blockDomains      domainList
+	schedules         []*schedule
+	safeSearch        safeSearch
+	blockBypass       bool
+	blockLists        []string // names of the blocklists
+	listCategories    []int    // pseudo categories of blockLists
 }
 
-var policyTable map[string]*policyHolder
-var policyMutex sync.RWMutex
-
-func getDnsConfigurationFiles() []string {
-    var files []string
-
-    root := "/etc/dnsproxy"
-    err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-        // fmt.Printf(path)
-        if strings.HasSuffix(path, ".json"){
-            files = append(files, path)
-        }
-        return nil
-    })
-    if err != nil {
-        panic(err)
-    }
-    return files    
+// errorAction is what we do with a query when the daemon lookup fails.
+type errorAction int
+
+const (
+	errorDefault errorAction = iota // use the server setting
+	errorAllow
+	errorBlock
+	errorServfail
+)
+
+func parseErrorAction(s string) (errorAction, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return errorDefault, nil
+	case "allow":
+		return errorAllow, nil
+	case "block":
+		return errorBlock, nil
+	case "servfail":
+		return errorServfail, nil
+	}
+	return errorDefault, fmt.Errorf("unknown error action %q", s)
 }
 
-func initializePolicy() {
-	policyTable = make(map[string]*policyHolder)
-
-	// dummy := new(policyHolder)
-	// dummy.networkAddress = "192.168.10.1"
-	// dummy.timestamp = time.Now()
-	// dummy.minimumReputation = 20
-	// dummy.blockCategories = append(dummy.blockCategories, 2)
-	// dummy.blockCategories = append(dummy.blockCategories, 4)
-	// dummy.blockCategories = append(dummy.blockCategories, 6)
-
-	// policyTable[dummy.networkAddress] = dummy
-
-
-    var customer Configuration
-    for _, file := range getDnsConfigurationFiles() {
-        // fmt.Println(file)
-
-        // fmt.Println("Open... " + file)
-        // Open our jsonFile
-        jsonFile, err := os.Open(file)
-        // if we os.Open returns an error then handle it
-        if err != nil {
-            fmt.Println(err)
-        }
-        // fmt.Println("Successfully opened " + file)
-        byteValue, _ := ioutil.ReadAll(jsonFile)
-        // fmt.Println("Successfully read " + file)
-        // defer the closing of our jsonFile so that we can parse it later on
-        defer jsonFile.Close()
-
-        json.Unmarshal(byteValue, &customer)
-        // fmt.Print(customer)
-        // fmt.Print(customer.CustomerId)
-        for _, policy := range customer.Policies{
-            // fmt.Print(policy)
-            for _, ipv4addr := range policy.Ipv4Addrs{
-                fmt.Print(ipv4addr)
-				pluginPolicy := new(policyHolder)
-				pluginPolicy.networkAddress = ipv4addr
-				pluginPolicy.minimumReputation = policy.BlockReputation
-				for _, category := range policy.BlockCategories{
-					pluginPolicy.blockCategories = append(pluginPolicy.blockCategories, category)
-				}
-				pluginPolicy.blockServer = policy.RedirectIp
+// blockAction is how we answer a blocked query.
+type blockAction int
+
+const (
+	blockRedirect blockAction = iota // answer with the block page address
+	blockNxdomain
+	blockRefused
+	blockNodata
+	blockCname
+)
+
+func parseBlockAction(s string) (blockAction, error) {
+	switch strings.ToLower(s) {
+	case "", "redirect":
+		return blockRedirect, nil
+	case "nxdomain":
+		return blockNxdomain, nil
+	case "refused":
+		return blockRefused, nil
+	case "nodata":
+		return blockNodata, nil
+	case "cname":
+		return blockCname, nil
+	}
+	return blockRedirect, fmt.Errorf("unknown block action %q", s)
+}
 
-				policyTable[pluginPolicy.networkAddress] = pluginPolicy
-            }
-        }
-    }
+// explainMode says how a blocked answer tells the client why it was blocked.
+type explainMode int
 
+const (
+	explainEDE explainMode = 1 << iota // extended DNS error option
+	explainTXT                         // TXT record in the additional section
+)
 
+func parseExplainMode(s string) (explainMode, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return 0, nil
+	case "ede":
+		return explainEDE, nil
+	case "txt":
+		return explainTXT, nil
+	case "both":
+		return explainEDE | explainTXT, nil
+	}
+	return 0, fmt.Errorf("unknown block explanation %q", s)
 }
 
-func checkPolicy(name string, client string, filter *Response) string {
-	log.Debugf("Checking policy for name:%s client:%s filter:%v\n", name, client, filter)
+// domainList is a list of domains a policy always allows or blocks. A
+// domain matches itself and every name below it, a wildcard domain such as
+// *.example.com only matches the names below it.
+type domainList []domainMatch
+
+type domainMatch struct {
+	name     string // lower case and fully qualified
+	wildcard bool
+}
+
+func parseDomain(s string) (domainMatch, error) {
+	d := domainMatch{name: s}
+	if strings.HasPrefix(s, "*.") {
+		d.name, d.wildcard = s[2:], true
+	}
+	if _, ok := dns.IsDomainName(d.name); !ok || d.name == "" || strings.Contains(d.name, "*") {
+		return domainMatch{}, fmt.Errorf("invalid domain name %q", s)
+	}
+	d.name = dns.Fqdn(strings.ToLower(d.name))
+	return d, nil
+}
+
+// match returns the domain in l that name falls under, if any.
+func (l domainList) match(name string) (string, bool) {
+	name = strings.ToLower(name)
+	for _, d := range l {
+		if d.wildcard && name == d.name {
+			continue
+		}
+		if dns.IsSubDomain(d.name, name) {
+			return d.name, true
+		}
+	}
+	return "", false
+}
+
+// blockReason says why a query was blocked.
+type blockReason struct {
+	kind     string // reputation, category, blocklist, rpz, domain, bypass or error
+	category int    // the blocked category for kind category
+	text     string
+}
 
-	// read lock the policy table get the policy for the client
-	policyMutex.RLock()
-	policy := policyTable[client]
-	policyMutex.RUnlock()
+// checkDomains looks name up in the allow and block domains of the policy.
+// It reports if name is listed and if so, if it is blocked and why. The
+// allow domains take precedence.
+func checkDomains(name string, policy *policyHolder) (reason blockReason, listed, blocked bool) {
+	if d, ok := policy.allowDomains.match(name); ok {
+		log.Debugf("Domain %s is allowed by %s\n", name, d)
+		return blockReason{}, true, false
+	}
+	if d, ok := policy.blockDomains.match(name); ok {
+		log.Debugf("Domain %s is blocked by %s\n", name, d)
+		return blockReason{kind: "domain", text: "domain " + strings.TrimSuffix(d, ".")}, true, true
+	}
+	return blockReason{}, false, false
+}
+
+// checkPolicy reports if the policy blocks name at time now, and if so why.
+func checkPolicy(name string, client string, policy *policyHolder, filter *Response, now time.Time) (blockReason, bool) {
+	log.Debugf("Checking policy for name:%s client:%s filter:%v\n", name, client, filter)
 
-	// if we did not find a policy for the client address return nothing to allow
+	// if we did not find a policy for the client address we allow
 	if policy == nil {
-		return ""
+		return blockReason{}, false
 	}
 
-	// if the reputation is below the client minimum return the block server
-	if filter.Reputation < policy.minimumReputation {
-		log.Debugf("Reputation %d < %d - Blocking %s for %s\n", filter.Reputation, policy.minimumReputation, name, client)
-		return policy.blockServer
+	// a schedule may change what is blocked at this time
+	minimumReputation, blockCategories := policy.rules(now)
+
+	// the blocklists of the policy apply whatever schedule is active
+	if len(policy.listCategories) > 0 {
+		blockCategories = append(blockCategories[:len(blockCategories):len(blockCategories)], policy.listCategories...)
+	}
+
+	// if the reputation is below the client minimum we block
+	if filter.Reputation < minimumReputation {
+		log.Debugf("Reputation %d < %d - Blocking %s for %s\n", filter.Reputation, minimumReputation, name, client)
+		return blockReason{kind: "reputation", text: fmt.Sprintf("reputation %d is below %d", filter.Reputation, minimumReputation)}, true
 	}
 
 	cathit := 0
+	catid := 0
 
 	// look through all of the categories returned from the daemon
 	// and see if any are blocked by the client policy
 	for xx := 0; xx < len(filter.Cats); xx++ {
-		for yy := 0; yy < len(policy.blockCategories); yy++ {
-			if (filter.Cats[xx].Catid == policy.blockCategories[yy]) {
+		for yy := 0; yy < len(blockCategories); yy++ {
+			if filter.Cats[xx].Catid == blockCategories[yy] {
+				if cathit == 0 {
+					catid = filter.Cats[xx].Catid
+				}
 				cathit++
 			}
 		}
 	}
 
-	// if no blocked categories were found return nothing to allow
+	// if no blocked categories were found we allow
 	if cathit == 0 {
-		return ""
+		return blockReason{}, false
 	}
 
 	log.Debugf("Category hit %d - Blocked %s for %s\n", cathit, name, client)
-	return policy.blockServer
+	return blockReason{kind: "category", category: catid, text: fmt.Sprintf("category %d", catid)}, true
 }
@@ -0,0 +1,34 @@
+package untangle
+
+import "testing"
+
+func TestDomainListMatch(t *testing.T) {
+	var l domainList
+	for _, s := range []string{"Example.com", "*.example.net"} {
+		d, err := parseDomain(s)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", s, err)
+		}
+		l = append(l, d)
+	}
+
+	tests := []struct {
+		name     string
+		expected string
+	}{
+		{"example.com.", "example.com."},
+		{"WWW.example.com.", "example.com."},
+		{"a.b.example.com.", "example.com."},
+		{"badexample.com.", ""},
+		{"example.net.", ""},
+		{"www.example.net.", "example.net."},
+		{"example.org.", ""},
+	}
+
+	for i, tc := range tests {
+		d, ok := l.match(tc.name)
+		if ok != (tc.expected != "") || d != tc.expected {
+			t.Errorf("Test %d: expected %s to match %q, got %q", i, tc.name, tc.expected, d)
+		}
+	}
+}
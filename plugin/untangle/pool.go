@@ -0,0 +1,262 @@
+/*
+ * pool.go
+ * This is the daemon connection pool for the Untangle DNS filter proxy
+ * We keep a small number of persistent TCP connections to the brightcloud
+ * daemon and pipeline lookups over them. The daemon answers every command
+ * with exactly one line and answers in order, so each connection keeps a
+ * FIFO of callers waiting for a reply.
+ */
+
+package untangle
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+)
+
+var (
+	errDaemonDown    = errors.New("filter daemon unavailable")
+	errDaemonTimeout = errors.New("filter daemon timeout")
+	errPoolStopped   = errors.New("filter daemon pool stopped")
+)
+
+// result is what a pipelined caller receives from the connection reader.
+type result struct {
+	line []byte
+	err  error
+}
+
+// daemonConn is one slot in the pool. The connection is dialed lazily and
+// replaced when it breaks.
+type daemonConn struct {
+	p *pool
+
+	sync.Mutex // protects conn, pending and writes to conn
+	conn       net.Conn
+	pending    []chan result
+	used       time.Time
+}
+
+// pool holds persistent, pipelined connections to the filter daemon.
+type pool struct {
+	addr        string
+	conns       []*daemonConn
+	next        uint32
+	dialTimeout time.Duration
+	timeout     time.Duration
+	hcInterval  time.Duration
+
+	mu      sync.Mutex // protects the reconnect backoff
+	backoff time.Duration
+	retryAt time.Time
+
+	stop    chan struct{}
+	stopped int32
+}
+
+func newPool(addr string, maxConns int) *pool {
+	p := &pool{
+		addr:        addr,
+		dialTimeout: defaultDialTimeout,
+		timeout:     defaultTimeout,
+		hcInterval:  defaultHealthCheck,
+		stop:        make(chan struct{}),
+	}
+	p.conns = make([]*daemonConn, maxConns)
+	for i := range p.conns {
+		p.conns[i] = &daemonConn{p: p}
+	}
+	return p
+}
+
+// Start starts the health checking of the pool connections.
+func (p *pool) Start() {
+	if p.hcInterval > 0 {
+		go p.healthCheck()
+	}
+}
+
+// Stop stops health checking and closes all connections.
+func (p *pool) Stop() {
+	if !atomic.CompareAndSwapInt32(&p.stopped, 0, 1) {
+		return
+	}
+	close(p.stop)
+	for _, dc := range p.conns {
+		dc.Lock()
+		conn := dc.conn
+		dc.Unlock()
+		if conn != nil {
+			dc.fail(conn, errPoolStopped)
+		}
+	}
+}
+
+// Exchange sends a single command line to the daemon and returns the reply line.
+func (p *pool) Exchange(command []byte) ([]byte, error) {
+	if atomic.LoadInt32(&p.stopped) == 1 {
+		return nil, errPoolStopped
+	}
+	i := atomic.AddUint32(&p.next, 1)
+	return p.conns[int(i)%len(p.conns)].exchange(command, p.timeout)
+}
+
+func (dc *daemonConn) exchange(command []byte, timeout time.Duration) ([]byte, error) {
+	ch := make(chan result, 1)
+
+	dc.Lock()
+	if dc.conn == nil {
+		if err := dc.dial(); err != nil {
+			dc.Unlock()
+			return nil, err
+		}
+	}
+	conn := dc.conn
+	conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(command); err != nil {
+		dc.Unlock()
+		dc.fail(conn, err)
+		return nil, err
+	}
+	dc.pending = append(dc.pending, ch)
+	dc.used = time.Now()
+	dc.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-ch:
+		return r.line, r.err
+	case <-timer.C:
+		// We can't tell how far behind the daemon is on this connection,
+		// so throw it away rather than risk pairing replies with the wrong callers.
+		dc.fail(conn, errDaemonTimeout)
+		return nil, errDaemonTimeout
+	}
+}
+
+// dial connects the slot, honoring the pool wide reconnect backoff. The caller must hold the lock.
+func (dc *daemonConn) dial() error {
+	p := dc.p
+	p.mu.Lock()
+	if time.Now().Before(p.retryAt) {
+		p.mu.Unlock()
+		return errDaemonDown
+	}
+	p.mu.Unlock()
+
+	conn, err := net.DialTimeout("tcp", p.addr, p.dialTimeout)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		if p.backoff == 0 {
+			p.backoff = minBackoff
+		} else if p.backoff *= 2; p.backoff > maxBackoff {
+			p.backoff = maxBackoff
+		}
+		p.retryAt = time.Now().Add(p.backoff)
+		log.Errorf("Error connecting to daemon %s (retry in %s): %v\n", p.addr, p.backoff, err)
+		return err
+	}
+	p.backoff = 0
+	p.retryAt = time.Time{}
+
+	dc.conn = conn
+	dc.used = time.Now()
+	go dc.read(conn)
+	return nil
+}
+
+// read delivers every reply line on conn to the oldest waiting caller.
+func (dc *daemonConn) read(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			dc.fail(conn, err)
+			return
+		}
+
+		dc.Lock()
+		if dc.conn != conn {
+			dc.Unlock()
+			return
+		}
+		if len(dc.pending) == 0 {
+			dc.Unlock()
+			log.Warningf("Unexpected reply from daemon %s: %s\n", dc.p.addr, line)
+			continue
+		}
+		ch := dc.pending[0]
+		dc.pending = dc.pending[1:]
+		dc.Unlock()
+
+		ch <- result{line: line}
+	}
+}
+
+// fail closes conn and fails every caller still waiting on it. It is a noop
+// if conn has already been replaced.
+func (dc *daemonConn) fail(conn net.Conn, err error) {
+	dc.Lock()
+	if dc.conn != conn {
+		dc.Unlock()
+		return
+	}
+	dc.conn = nil
+	pending := dc.pending
+	dc.pending = nil
+	dc.Unlock()
+
+	conn.Close()
+	for _, ch := range pending {
+		ch <- result{err: err}
+	}
+}
+
+// healthCheck periodically probes idle connections so broken ones are
+// replaced before a query needs them, and redials empty slots once the
+// reconnect backoff allows it.
+func (p *pool) healthCheck() {
+	tick := time.NewTicker(p.hcInterval)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-tick.C:
+			for _, dc := range p.conns {
+				dc.Lock()
+				idle := dc.conn == nil || (len(dc.pending) == 0 && time.Since(dc.used) >= p.hcInterval)
+				dc.Unlock()
+				if idle {
+					if _, err := dc.exchange(healthCommand, p.timeout); err != nil {
+						log.Debugf("Health check of daemon %s failed: %v\n", p.addr, err)
+					}
+				}
+			}
+		}
+	}
+}
+
+// healthCommand is a lookup for the root name, the reply is ignored.
+var healthCommand = []byte(`{"url/getinfo":{"urls":["."],"a1cat":1,"reputation":1}}` + "\r\n")
+
+const (
+	defaultMaxConns    = 4
+	defaultDialTimeout = 1 * time.Second
+	defaultTimeout     = 2 * time.Second
+	defaultHealthCheck = 5 * time.Second
+
+	minBackoff = 250 * time.Millisecond
+	maxBackoff = 10 * time.Second
+)
@@ -0,0 +1,180 @@
+package untangle
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeDaemon answers url/getinfo commands like the brightcloud daemon does.
+type fakeDaemon struct {
+	ln      net.Listener
+	answer  func(url string) Response
+	conns   int32
+	queries int32
+}
+
+func newFakeDaemon(t *testing.T, answer func(url string) Response) *fakeDaemon {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	d := &fakeDaemon{ln: ln, answer: answer}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&d.conns, 1)
+			go d.serve(conn)
+		}
+	}()
+	return d
+}
+
+func (d *fakeDaemon) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&d.queries, 1)
+		var cmd getInfoCommand
+		json.Unmarshal(line, &cmd)
+		var resp []Response
+		for _, u := range cmd.GetInfo.Urls {
+			resp = append(resp, d.answer(u))
+		}
+		buf, _ := json.Marshal(resp)
+		conn.Write(append(buf, '\n'))
+	}
+}
+
+func (d *fakeDaemon) Addr() string { return d.ln.Addr().String() }
+func (d *fakeDaemon) Close()       { d.ln.Close() }
+
+func echoDaemon(url string) Response { return Response{Url: url, Reputation: 80} }
+
+func command(url string) []byte {
+	buf, _ := json.Marshal(getInfoCommand{GetInfo: getInfo{Urls: []string{url}, A1cat: 1, Reputation: 1}})
+	return append(buf, '\r', '\n')
+}
+
+func TestPoolPipelining(t *testing.T) {
+	d := newFakeDaemon(t, echoDaemon)
+	defer d.Close()
+
+	p := newPool(d.Addr(), 2)
+	p.hcInterval = 0
+	p.Start()
+	defer p.Stop()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("host%d.example.org.", i)
+			line, err := p.Exchange(command(name))
+			if err != nil {
+				t.Errorf("Expected no error, got %v", err)
+				return
+			}
+			var resp []Response
+			if err := json.Unmarshal(line, &resp); err != nil || len(resp) != 1 {
+				t.Errorf("Bad reply %q: %v", line, err)
+				return
+			}
+			if resp[0].Url != name {
+				t.Errorf("Expected reply for %s, got %s", name, resp[0].Url)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if x := atomic.LoadInt32(&d.conns); x > 2 {
+		t.Errorf("Expected at most 2 connections, got %d", x)
+	}
+	if x := atomic.LoadInt32(&d.queries); x != 50 {
+		t.Errorf("Expected 50 queries, got %d", x)
+	}
+}
+
+func TestPoolReconnect(t *testing.T) {
+	d := newFakeDaemon(t, echoDaemon)
+	defer d.Close()
+
+	p := newPool(d.Addr(), 1)
+	p.hcInterval = 0
+	defer p.Stop()
+
+	if _, err := p.Exchange(command("example.org.")); err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+
+	// break the connection underneath the pool, the next exchange may fail
+	// but the one after must succeed on a fresh connection
+	p.conns[0].Lock()
+	p.conns[0].conn.Close()
+	p.conns[0].Unlock()
+
+	p.Exchange(command("example.org."))
+	if _, err := p.Exchange(command("example.org.")); err != nil {
+		t.Fatalf("Expected no error after reconnect, got %v", err)
+	}
+	if x := atomic.LoadInt32(&d.conns); x != 2 {
+		t.Errorf("Expected 2 connections, got %d", x)
+	}
+}
+
+func TestPoolBackoff(t *testing.T) {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+
+	p := newPool(addr, 1)
+	p.hcInterval = 0
+	defer p.Stop()
+
+	if _, err := p.Exchange(command("example.org.")); err == nil {
+		t.Fatalf("Expected error from unreachable daemon")
+	}
+	if _, err := p.Exchange(command("example.org.")); err != errDaemonDown {
+		t.Errorf("Expected %v while backing off, got %v", errDaemonDown, err)
+	}
+}
+
+func TestPoolTimeout(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		// accept and never answer
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	p := newPool(ln.Addr().String(), 1)
+	p.hcInterval = 0
+	p.timeout = 50 * time.Millisecond
+	defer p.Stop()
+
+	if _, err := p.Exchange(command("example.org.")); err != errDaemonTimeout {
+		t.Errorf("Expected %v, got %v", errDaemonTimeout, err)
+	}
+}
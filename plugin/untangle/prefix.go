@@ -0,0 +1,156 @@
+/*
+ * prefix.go
+ * This is the client address lookup table for the Untangle DNS filter proxy
+ * Policies are indexed by IPv4 and IPv6 network prefixes in a binary trie
+ * so a client address can be matched to the most specific policy network.
+ */
+
+package untangle
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// prefixTable maps IPv4 and IPv6 networks to values, policies or RPZ rules,
+// and returns the value of the longest prefix that contains a given address.
+type prefixTable struct {
+	v4   *prefixNode
+	v6   *prefixNode
+	size int
+}
+
+// prefixNode is a node in the binary trie. A node only carries a value when
+// a prefix ends at that exact bit position.
+type prefixNode struct {
+	child [2]*prefixNode
+	value interface{}
+}
+
+func newPrefixTable() *prefixTable {
+	return &prefixTable{v4: new(prefixNode), v6: new(prefixNode)}
+}
+
+// parsePrefix parses an address or a CIDR prefix. A bare address is treated
+// as a host prefix (/32 or /128).
+func parsePrefix(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network address %q", s)
+		}
+		if n = canonicalPrefix(n); n == nil {
+			return nil, fmt.Errorf("invalid network address %q", s)
+		}
+		return n, nil
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid network address %q", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// canonicalPrefix returns n with an IPv4-mapped IPv6 network, such as
+// ::ffff:10.0.0.0/104, turned into the IPv4 network, so the address and the
+// mask have the same length. It returns nil if the mask doesn't fit the
+// address.
+func canonicalPrefix(n *net.IPNet) *net.IPNet {
+	ones, bits := n.Mask.Size()
+	if ip4 := n.IP.To4(); ip4 != nil {
+		if bits == net.IPv6len*8 {
+			ones -= 96
+		} else if bits != net.IPv4len*8 {
+			return nil
+		}
+		if ones < 0 {
+			return nil
+		}
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(ones, net.IPv4len*8)}
+	}
+	if len(n.IP) != net.IPv6len || bits != net.IPv6len*8 {
+		return nil
+	}
+	return n
+}
+
+// insert adds the network to the table. An existing entry for exactly the
+// same network is replaced, a network with a mask that doesn't fit its
+// address is ignored.
+func (t *prefixTable) insert(n *net.IPNet, v interface{}) {
+	if n = canonicalPrefix(n); n == nil {
+		return
+	}
+	node, ip := t.root(n.IP)
+	if node == nil {
+		return
+	}
+	ones, _ := n.Mask.Size()
+
+	for i := 0; i < ones; i++ {
+		b := bit(ip, i)
+		if node.child[b] == nil {
+			node.child[b] = new(prefixNode)
+		}
+		node = node.child[b]
+	}
+
+	if node.value == nil {
+		t.size++
+	}
+	node.value = v
+}
+
+// lookup returns the policy for the most specific network containing ip, or
+// nil if no network matches.
+func (t *prefixTable) lookup(ip net.IP) *policyHolder {
+	p, _ := t.match(ip).(*policyHolder)
+	return p
+}
+
+// match returns the value for the most specific network containing ip, or
+// nil if no network matches.
+func (t *prefixTable) match(ip net.IP) interface{} {
+	node, ip := t.root(ip)
+	if node == nil {
+		return nil
+	}
+
+	match := node.value
+	for i := 0; i < len(ip)*8; i++ {
+		node = node.child[bit(ip, i)]
+		if node == nil {
+			break
+		}
+		if node.value != nil {
+			match = node.value
+		}
+	}
+	return match
+}
+
+// Len returns the number of networks in the table.
+func (t *prefixTable) Len() int { return t.size }
+
+// root returns the trie for the address family of ip along with ip in its
+// canonical 4 or 16 byte form.
+func (t *prefixTable) root(ip net.IP) (*prefixNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return t.v4, ip4
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return t.v6, ip16
+	}
+	return nil, nil
+}
+
+// bit returns bit i of ip, counting from the most significant bit.
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
@@ -0,0 +1,123 @@
+package untangle
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPrefixTableLookup(t *testing.T) {
+	table := newPrefixTable()
+	for _, s := range []string{"10.0.0.0/8", "10.1.2.0/24", "10.1.2.3", "2001:db8::/32", "2001:db8:1::/64"} {
+		n, err := parsePrefix(s)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", s, err)
+		}
+		table.insert(n, &policyHolder{networkAddress: n.String()})
+	}
+
+	if x := table.Len(); x != 5 {
+		t.Errorf("Expected 5 networks, got %d", x)
+	}
+
+	tests := []struct {
+		client   string
+		expected string
+	}{
+		{"10.9.9.9", "10.0.0.0/8"},
+		{"10.1.2.4", "10.1.2.0/24"},
+		{"10.1.2.3", "10.1.2.3/32"},
+		{"192.168.1.1", ""},
+		{"2001:db8:1::53", "2001:db8:1::/64"},
+		{"2001:db8:2::53", "2001:db8::/32"},
+		{"2001:db9::1", ""},
+		{"::ffff:10.1.2.3", "10.1.2.3/32"},
+	}
+
+	for i, tc := range tests {
+		p := table.lookup(net.ParseIP(tc.client))
+		got := ""
+		if p != nil {
+			got = p.networkAddress
+		}
+		if got != tc.expected {
+			t.Errorf("Test %d: expected %q for %s, got %q", i, tc.expected, tc.client, got)
+		}
+	}
+}
+
+func TestPrefixTableDefaultRoute(t *testing.T) {
+	table := newPrefixTable()
+	n, _ := parsePrefix("0.0.0.0/0")
+	table.insert(n, &policyHolder{networkAddress: n.String()})
+
+	if p := table.lookup(net.ParseIP("198.51.100.7")); p == nil {
+		t.Errorf("Expected 0.0.0.0/0 to match an IPv4 client")
+	}
+	if p := table.lookup(net.ParseIP("2001:db8::1")); p != nil {
+		t.Errorf("Expected 0.0.0.0/0 not to match an IPv6 client")
+	}
+	if p := table.lookup(nil); p != nil {
+		t.Errorf("Expected no match for an invalid address")
+	}
+}
+
+func TestPrefixTableMapped(t *testing.T) {
+	table := newPrefixTable()
+
+	// an IPv4-mapped network with an IPv6 mask, as parsed by net.ParseCIDR
+	_, n, err := net.ParseCIDR("::ffff:10.0.0.0/104")
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.insert(n, &policyHolder{networkAddress: "mapped"})
+	// masks that don't fit the address are ignored
+	table.insert(&net.IPNet{IP: net.ParseIP("2001:db8::"), Mask: net.CIDRMask(16, 32)}, &policyHolder{})
+	table.insert(&net.IPNet{IP: net.ParseIP("10.0.0.0").To4(), Mask: net.CIDRMask(64, 128)}, &policyHolder{})
+
+	if x := table.Len(); x != 1 {
+		t.Errorf("Expected 1 network, got %d", x)
+	}
+	for _, client := range []string{"10.1.2.3", "::ffff:10.1.2.3"} {
+		if p := table.lookup(net.ParseIP(client)); p == nil || p.networkAddress != "mapped" {
+			t.Errorf("Expected the mapped network for %s, got %+v", client, p)
+		}
+	}
+	if p := table.lookup(net.ParseIP("11.0.0.1")); p != nil {
+		t.Errorf("Expected no match for 11.0.0.1, got %+v", p)
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  string
+		shouldErr bool
+	}{
+		{"192.0.2.1", "192.0.2.1/32", false},
+		{"192.0.2.77/24", "192.0.2.0/24", false},
+		{"2001:db8::1", "2001:db8::1/128", false},
+		{"2001:db8::/64", "2001:db8::/64", false},
+		{"::ffff:10.0.0.0/104", "10.0.0.0/8", false},
+		{"::ffff:192.0.2.1", "192.0.2.1/32", false},
+		{"192.0.2.300", "", true},
+		{"192.0.2.0/33", "", true},
+		{"example.org", "", true},
+	}
+
+	for i, tc := range tests {
+		n, err := parsePrefix(tc.input)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error for %q, got none", i, tc.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error for %q, got %v", i, tc.input, err)
+			continue
+		}
+		if n.String() != tc.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, tc.expected, n)
+		}
+	}
+}
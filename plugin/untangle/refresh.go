@@ -0,0 +1,87 @@
+/*
+ * refresh.go
+ * This is the background refresh of the Untangle DNS filter proxy sources
+ * Blocklists and response policy zones are loaded at startup and loaded
+ * again every refresh interval. A file that hasn't changed since the last
+ * load is not parsed again.
+ */
+
+package untangle
+
+import (
+	"io"
+	"os"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// refresher calls reload at startup and then every refresh interval. On
+// failure the error is logged and what was loaded before stays in use.
+type refresher struct {
+	refresh time.Duration
+	reload  func() error
+
+	// only used by readFile
+	mtime time.Time
+	size  int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Start loads the source and refreshes it in the background.
+func (r *refresher) Start() {
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(r.refresh)
+		defer ticker.Stop()
+		for {
+			if err := r.reload(); err != nil {
+				log.Errorf("%v\n", err)
+			}
+			select {
+			case <-ticker.C:
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops refreshing the source.
+func (r *refresher) Stop() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+	r.stop = nil
+}
+
+// readFile calls parse with the file at path, unless loaded is set and the
+// modification time and size of the file are those of the last successful
+// parse. It reports if parse was called.
+func (r *refresher) readFile(path string, loaded bool, parse func(io.Reader) error) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if loaded && stat.ModTime().Equal(r.mtime) && stat.Size() == r.size {
+		return false, nil
+	}
+
+	if err := parse(f); err != nil {
+		return false, err
+	}
+	r.mtime, r.size = stat.ModTime(), stat.Size()
+	return true, nil
+}
@@ -0,0 +1,549 @@
+/*
+ * rpz.go
+ * This is the Response Policy Zone support for the Untangle DNS filter proxy
+ * An RPZ is a DNS zone whose owner names are triggers and whose records are
+ * the actions. The zones are read from a file or transferred from a primary
+ * server and compiled into lookup tables. The triggers understood are, in
+ * a zone with origin rpz.example.org:
+ *
+ *	bad.example.com.rpz.example.org            QNAME, *.bad.example.com for the names below
+ *	24.0.2.0.192.rpz-ip.rpz.example.org        RPZ-IP, an address in the answer
+ *	32.1.2.0.10.rpz-client-ip.rpz.example.org  RPZ-CLIENT-IP, the address of the client
+ *	ns.bad.example.rpz-nsdname.rpz.example.org NSDNAME, a name server of the queried zone
+ *
+ * and the actions are a CNAME to . (NXDOMAIN), to *. (NODATA), to
+ * rpz-passthru. (PASSTHRU), to rpz-drop. (DROP) or to rpz-tcp-only., or any
+ * other records, which are local data answered in place of the real ones.
+ */
+
+package untangle
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/file"
+	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/plugin/pkg/nonwriter"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+)
+
+const defaultRPZRefresh = time.Minute
+
+// rpzAction is what an RPZ rule does with a query.
+type rpzAction int
+
+const (
+	rpzLocal rpzAction = iota // answer with the local data of the rule
+	rpzNxdomain
+	rpzNodata
+	rpzPassthru
+	rpzDrop
+	rpzTCPOnly
+)
+
+// rpzRule is the action for one trigger of a zone.
+type rpzRule struct {
+	zone    string // origin of the zone, for the block reason
+	trigger string // owner name relative to the zone
+	action  rpzAction
+	data    []dns.RR // local data
+}
+
+// rpzRules are the compiled triggers of a zone.
+type rpzRules struct {
+	qname           map[string]*rpzRule
+	qnameWildcard   map[string]*rpzRule // keyed by the name below the *
+	nsdname         map[string]*rpzRule
+	nsdnameWildcard map[string]*rpzRule
+	ip              *prefixTable
+	clientIP        *prefixTable
+	size            int
+	serial          uint32
+}
+
+// rpzZone is a response policy zone read from a file or a primary server.
+type rpzZone struct {
+	origin    string
+	path      string   // zone file
+	primaries []string // or the servers to transfer it from
+	refresher
+
+	sync.RWMutex // protects rules
+	rules        *rpzRules
+}
+
+func newRPZFile(origin, path string) *rpzZone {
+	z := &rpzZone{origin: dns.Fqdn(strings.ToLower(origin)), path: path}
+	z.refresher = refresher{refresh: defaultRPZRefresh, reload: z.load}
+	return z
+}
+
+func newRPZPrimary(origin string, primaries []string) *rpzZone {
+	z := &rpzZone{origin: dns.Fqdn(strings.ToLower(origin)), primaries: primaries}
+	z.refresher = refresher{refresh: defaultRPZRefresh, reload: z.load}
+	return z
+}
+
+func (z *rpzZone) current() *rpzRules {
+	z.RLock()
+	defer z.RUnlock()
+	return z.rules
+}
+
+// load reads or transfers the zone again if it has changed.
+func (z *rpzZone) load() error {
+	var (
+		zone *file.Zone
+		err  error
+	)
+	if z.path != "" {
+		zone, err = z.read()
+	} else {
+		zone, err = z.transfer()
+	}
+	if err != nil {
+		RPZLoadCount.WithLabelValues(z.origin, "failure").Inc()
+		return fmt.Errorf("rpz %s: %v", z.origin, err)
+	}
+	if zone == nil {
+		// unchanged
+		return nil
+	}
+
+	rules := compileRPZ(z.origin, zone)
+	RPZLoadCount.WithLabelValues(z.origin, "success").Inc()
+	RPZRuleCount.WithLabelValues(z.origin).Set(float64(rules.size))
+	log.Infof("Loaded %d rules for rpz %s serial %d\n", rules.size, z.origin, rules.serial)
+
+	z.Lock()
+	z.rules = rules
+	z.Unlock()
+	return nil
+}
+
+// read parses the zone file if its modification time or size changed.
+func (z *rpzZone) read() (*file.Zone, error) {
+	var zone *file.Zone
+	_, err := z.readFile(z.path, z.current() != nil, func(r io.Reader) (err error) {
+		zone, err = file.Parse(r, z.origin, z.path, -1)
+		return err
+	})
+	return zone, err
+}
+
+// transfer transfers the zone from the primaries if their serial differs
+// from ours.
+func (z *rpzZone) transfer() (*file.Zone, error) {
+	if rules := z.current(); rules != nil {
+		serial, err := z.primarySerial()
+		if err != nil {
+			return nil, err
+		}
+		if serial == rules.serial {
+			return nil, nil
+		}
+	}
+
+	zone := file.NewZone(z.origin, "")
+	zone.TransferFrom = z.primaries
+	if err := zone.TransferIn(); err != nil {
+		return nil, err
+	}
+	return zone, nil
+}
+
+// primarySerial returns the SOA serial of the zone on the first primary
+// that answers.
+func (z *rpzZone) primarySerial() (uint32, error) {
+	c := &dns.Client{Net: "tcp", Timeout: defaultTimeout}
+	m := new(dns.Msg)
+	m.SetQuestion(z.origin, dns.TypeSOA)
+
+	err := fmt.Errorf("no SOA record")
+	for _, primary := range z.primaries {
+		var ret *dns.Msg
+		ret, _, err = c.Exchange(m, primary)
+		if err != nil {
+			continue
+		}
+		for _, rr := range ret.Answer {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return soa.Serial, nil
+			}
+		}
+		err = fmt.Errorf("no SOA record from %s", primary)
+	}
+	return 0, err
+}
+
+// compileRPZ turns the records of zone into rules. Triggers we don't
+// understand, such as RPZ-NSIP, are skipped.
+func compileRPZ(origin string, zone *file.Zone) *rpzRules {
+	rules := &rpzRules{
+		qname:           make(map[string]*rpzRule),
+		qnameWildcard:   make(map[string]*rpzRule),
+		nsdname:         make(map[string]*rpzRule),
+		nsdnameWildcard: make(map[string]*rpzRule),
+		ip:              newPrefixTable(),
+		clientIP:        newPrefixTable(),
+	}
+	if zone.Apex.SOA != nil {
+		rules.serial = zone.Apex.SOA.Serial
+	}
+
+	owners := make(map[string]*rpzRule)
+	for _, elem := range zone.All() {
+		for _, rr := range elem.All() {
+			owner := strings.ToLower(rr.Header().Name)
+			if owner == origin || !dns.IsSubDomain(origin, owner) {
+				continue
+			}
+			rule := owners[owner]
+			if rule == nil {
+				rule = &rpzRule{zone: strings.TrimSuffix(origin, "."), trigger: strings.TrimSuffix(owner, "."+origin)}
+				owners[owner] = rule
+			}
+			rule.add(rr)
+		}
+	}
+
+	for _, rule := range owners {
+		if rules.insert(rule) {
+			rules.size++
+		} else {
+			log.Debugf("Skipping rpz trigger %s in %s\n", rule.trigger, origin)
+		}
+	}
+	return rules
+}
+
+// add adds the action or local data of rr to the rule.
+func (r *rpzRule) add(rr dns.RR) {
+	if cname, ok := rr.(*dns.CNAME); ok {
+		switch strings.ToLower(cname.Target) {
+		case ".":
+			r.action = rpzNxdomain
+			return
+		case "*.":
+			r.action = rpzNodata
+			return
+		case "rpz-passthru.":
+			r.action = rpzPassthru
+			return
+		case "rpz-drop.":
+			r.action = rpzDrop
+			return
+		case "rpz-tcp-only.":
+			r.action = rpzTCPOnly
+			return
+		}
+	}
+	r.data = append(r.data, rr)
+}
+
+// insert adds the rule under its trigger and reports if the trigger is
+// understood.
+func (rules *rpzRules) insert(rule *rpzRule) bool {
+	name := rule.trigger + "."
+	switch {
+	case strings.HasSuffix(name, ".rpz-ip."):
+		n, err := parseRPZPrefix(strings.TrimSuffix(name, ".rpz-ip."))
+		if err != nil {
+			return false
+		}
+		rules.ip.insert(n, rule)
+	case strings.HasSuffix(name, ".rpz-client-ip."):
+		n, err := parseRPZPrefix(strings.TrimSuffix(name, ".rpz-client-ip."))
+		if err != nil {
+			return false
+		}
+		rules.clientIP.insert(n, rule)
+	case strings.HasSuffix(name, ".rpz-nsdname."):
+		insertName(rules.nsdname, rules.nsdnameWildcard, strings.TrimSuffix(name, "rpz-nsdname."), rule)
+	case strings.Contains(name, ".rpz-"):
+		return false
+	default:
+		insertName(rules.qname, rules.qnameWildcard, name, rule)
+	}
+	return true
+}
+
+func insertName(exact, wildcard map[string]*rpzRule, name string, rule *rpzRule) {
+	if strings.HasPrefix(name, "*.") {
+		wildcard[name[2:]] = rule
+		return
+	}
+	exact[name] = rule
+}
+
+// reason is why a query hit by the rule is blocked.
+func (rule *rpzRule) reason() blockReason {
+	return blockReason{kind: "rpz", text: "rpz " + rule.zone + " " + rule.trigger}
+}
+
+// matchName returns the rule for name, an exact trigger takes precedence
+// over the wildcard triggers, of which the most specific one is used.
+func matchName(exact, wildcard map[string]*rpzRule, name string) *rpzRule {
+	name = strings.ToLower(dns.Fqdn(name))
+	if rule, ok := exact[name]; ok {
+		return rule
+	}
+	for off, end := dns.NextLabel(name, 0); !end; off, end = dns.NextLabel(name, off) {
+		if rule, ok := wildcard[name[off:]]; ok {
+			return rule
+		}
+	}
+	return nil
+}
+
+// parseRPZPrefix parses the reversed address of an IP trigger, such as
+// 24.0.2.0.192 for 192.0.2.0/24 or 64.zz.db8.2001 for 2001:db8::/64. An
+// IPv4-mapped address, 104.0.a00.ffff.zz for ::ffff:10.0.0.0/104, is
+// returned as the IPv4 network.
+func parseRPZPrefix(s string) (*net.IPNet, error) {
+	labels := strings.Split(s, ".")
+	if len(labels) < 2 {
+		return nil, fmt.Errorf("invalid rpz address %q", s)
+	}
+	bits, err := strconv.Atoi(labels[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid rpz prefix length %q", s)
+	}
+
+	parts := make([]string, 0, len(labels)-1)
+	v6 := false
+	for i := len(labels) - 1; i > 0; i-- {
+		if labels[i] == "zz" {
+			v6 = true
+			labels[i] = ""
+		}
+		parts = append(parts, labels[i])
+	}
+
+	var addr string
+	if !v6 && len(parts) == 4 {
+		addr = strings.Join(parts, ".")
+	} else {
+		addr = strings.Join(parts, ":")
+		if strings.HasPrefix(addr, ":") {
+			addr = ":" + addr
+		}
+		if strings.HasSuffix(addr, ":") {
+			addr += ":"
+		}
+	}
+
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid rpz address %q", s)
+	}
+	size := net.IPv6len * 8
+	if ip4 := ip.To4(); ip4 != nil && !v6 && len(parts) == 4 {
+		ip, size = ip4, net.IPv4len*8
+	}
+	if bits < 0 || bits > size {
+		return nil, fmt.Errorf("invalid rpz prefix length %q", s)
+	}
+	// a trigger for IPv4-mapped addresses matches the IPv4 clients
+	mask := net.CIDRMask(bits, size)
+	n := canonicalPrefix(&net.IPNet{IP: ip.Mask(mask), Mask: mask})
+	if n == nil {
+		return nil, fmt.Errorf("invalid rpz prefix length %q", s)
+	}
+	return n, nil
+}
+
+// rpzClient returns the address RPZ-CLIENT-IP triggers are matched with: the
+// client found by client_id when it is an address, the source address of the
+// query when the client is a device or there is no client_id.
+func rpzClient(client, source string) net.IP {
+	if ip := net.ParseIP(client); ip != nil {
+		return ip
+	}
+	return net.ParseIP(source)
+}
+
+// rpzQuery returns the rule triggered by the client or the query name in
+// the first zone that has one. Within a zone a client trigger takes
+// precedence over a query name trigger.
+func (ut *Untangle) rpzQuery(client net.IP, name string) *rpzRule {
+	for _, z := range ut.rpz {
+		rules := z.current()
+		if rules == nil {
+			continue
+		}
+		if rule, ok := rules.clientIP.match(client).(*rpzRule); ok {
+			return rule
+		}
+		if rule := matchName(rules.qname, rules.qnameWildcard, name); rule != nil {
+			return rule
+		}
+	}
+	return nil
+}
+
+// rpzResponse returns the rule triggered by an address in the answer or a
+// name server of the queried zone in the first zone that has one.
+func (ut *Untangle) rpzResponse(ctx context.Context, state request.Request, res *dns.Msg) *rpzRule {
+	var nameservers []string
+	for _, z := range ut.rpz {
+		rules := z.current()
+		if rules == nil {
+			continue
+		}
+		if rules.ip.Len() > 0 {
+			for _, rr := range res.Answer {
+				var ip net.IP
+				switch rr := rr.(type) {
+				case *dns.A:
+					ip = rr.A
+				case *dns.AAAA:
+					ip = rr.AAAA
+				default:
+					continue
+				}
+				if rule, ok := rules.ip.match(ip).(*rpzRule); ok {
+					return rule
+				}
+			}
+		}
+		if len(rules.nsdname) > 0 || len(rules.nsdnameWildcard) > 0 {
+			if nameservers == nil {
+				nameservers = ut.nameservers(ctx, state)
+			}
+			for _, ns := range nameservers {
+				if rule := matchName(rules.nsdname, rules.nsdnameWildcard, ns); rule != nil {
+					return rule
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// nameservers returns the name servers of the zone the query name is in, as
+// the rest of the chain sees them. If the query name has no NS records the
+// SOA in the authority section tells us which zone to ask for.
+func (ut *Untangle) nameservers(ctx context.Context, state request.Request) []string {
+	name := state.Name()
+	for i := 0; i < 2; i++ {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeNS)
+		nw := nonwriter.New(state.W)
+		plugin.NextOrFailure(ut.Name(), ut.Next, ctx, nw, m)
+		if nw.Msg == nil {
+			break
+		}
+
+		var nameservers []string
+		for _, rr := range nw.Msg.Answer {
+			if ns, ok := rr.(*dns.NS); ok {
+				nameservers = append(nameservers, ns.Ns)
+			}
+		}
+		if len(nameservers) > 0 {
+			return nameservers
+		}
+
+		apex := ""
+		for _, rr := range nw.Msg.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				apex = soa.Hdr.Name
+			}
+		}
+		if apex == "" || apex == name {
+			break
+		}
+		name = apex
+	}
+	// not nil, so we don't ask again for the next zone
+	return []string{}
+}
+
+// rpzRespond answers the query according to rule. It returns false when the
+// rule lets the query through: PASSTHRU, and TCP-ONLY for a query that came
+// over TCP.
+func (ut *Untangle) rpzRespond(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, state request.Request, policy *policyHolder, d *decision, rule *rpzRule) bool {
+	if rule.action == rpzPassthru || (rule.action == rpzTCPOnly && state.Proto() == "tcp") {
+		return false
+	}
+
+	d.blockedBy(rule.reason())
+	if rule.action == rpzDrop {
+		return true
+	}
+
+	a := new(dns.Msg)
+	a.SetReply(r)
+	a.Authoritative = true
+
+	switch rule.action {
+	case rpzNxdomain:
+		a.Rcode = dns.RcodeNameError
+	case rpzNodata:
+	case rpzTCPOnly:
+		a.Truncated = true
+		a.Authoritative = false
+	case rpzLocal:
+		for _, rr := range rule.data {
+			if cname, ok := rr.(*dns.CNAME); ok && state.QType() != dns.TypeCNAME {
+				ut.rewrite(ctx, w, r, state, cname.Target)
+				return true
+			}
+			if rr.Header().Rrtype != state.QType() {
+				continue
+			}
+			rr = dns.Copy(rr)
+			rr.Header().Name = state.QName()
+			a.Answer = append(a.Answer, rr)
+		}
+	}
+
+	explain(a, state, policy.explain, d.reason)
+
+	w.WriteMsg(a)
+	return true
+}
+
+// rpzWriter checks the answer for RPZ-IP and NSDNAME triggers before it is
+// written to the client.
+type rpzWriter struct {
+	dns.ResponseWriter
+	*Untangle
+	ctx      context.Context
+	state    request.Request
+	policy   *policyHolder
+	decision *decision
+}
+
+// WriteMsg implements the dns.ResponseWriter interface.
+func (w *rpzWriter) WriteMsg(res *dns.Msg) error {
+	if res.Rcode == dns.RcodeSuccess {
+		if rule := w.rpzResponse(w.ctx, w.state, res); rule != nil {
+			if w.rpzRespond(w.ctx, w.ResponseWriter, w.state.Req, w.state, w.policy, w.decision, rule) {
+				return nil
+			}
+		}
+	}
+	return w.ResponseWriter.WriteMsg(res)
+}
+
+// rpzResponseTriggers reports if any zone has triggers that need the answer.
+func (ut *Untangle) rpzResponseTriggers() bool {
+	for _, z := range ut.rpz {
+		if rules := z.current(); rules != nil && (rules.ip.Len() > 0 || len(rules.nsdname) > 0 || len(rules.nsdnameWildcard) > 0) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,373 @@
+package untangle
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+const testRPZ = `$ORIGIN rpz.example.org.
+@                     300 IN SOA ns.rpz.example.org. admin.rpz.example.org. 1 3600 600 86400 60
+@                     300 IN NS  ns.rpz.example.org.
+bad.example.com       300 IN CNAME .
+*.bad.example.com     300 IN CNAME *.
+ok.bad.example.com    300 IN CNAME rpz-passthru.
+drop.example.com      300 IN CNAME rpz-drop.
+tcp.example.com       300 IN CNAME rpz-tcp-only.
+garden.example.com    300 IN A     192.0.2.99
+garden.example.com    300 IN TXT   "walled garden"
+redirect.example.com  300 IN CNAME walled.example.net.
+24.0.100.51.198.rpz-ip 300 IN CNAME .
+ns.evil.example.rpz-nsdname 300 IN CNAME .
+4.3.2.1.32.rpz-nsip   300 IN CNAME .
+`
+
+// loadRPZ loads the zone in content from a file.
+func loadRPZ(t *testing.T, origin, content string) *rpzZone {
+	f, err := ioutil.TempFile("", "rpz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(content)
+	f.Close()
+
+	z := newRPZFile(origin, f.Name())
+	if err := z.load(); err != nil {
+		t.Fatal(err)
+	}
+	return z
+}
+
+func TestParseRPZPrefix(t *testing.T) {
+	tests := []struct {
+		input     string
+		expected  string
+		shouldErr bool
+	}{
+		{"32.1.2.0.192", "192.0.2.1/32", false},
+		{"24.0.2.0.192", "192.0.2.0/24", false},
+		{"8.9.2.0.10", "10.0.0.0/8", false},
+		{"128.1.zz.db8.2001", "2001:db8::1/128", false},
+		{"48.zz.a.db8.2001", "2001:db8:a::/48", false},
+		{"128.1.zz", "::1/128", false},
+		{"104.0.a00.ffff.zz", "10.0.0.0/8", false},
+		{"128.1.a00.ffff.zz", "10.0.0.1/32", false},
+		{"33.1.2.0.192", "", true},
+		{"32.1.2.0", "", true},
+		{"x.1.2.0.192", "", true},
+		{"32", "", true},
+	}
+
+	for i, tc := range tests {
+		n, err := parseRPZPrefix(tc.input)
+		if tc.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error for %s, got %s", i, tc.input, n)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error for %s, got %v", i, tc.input, err)
+			continue
+		}
+		if n.String() != tc.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, tc.expected, n)
+		}
+	}
+}
+
+func TestCompileRPZ(t *testing.T) {
+	rules := loadRPZ(t, "rpz.example.org", testRPZ).current()
+
+	// garden.example.com is one rule and the rpz-nsip trigger is skipped
+	if rules.size != 9 || rules.serial != 1 {
+		t.Errorf("Expected 9 rules of serial 1, got %d of serial %d", rules.size, rules.serial)
+	}
+
+	tests := []struct {
+		name     string
+		expected string // trigger, empty when none
+		action   rpzAction
+	}{
+		{"bad.example.com.", "bad.example.com", rpzNxdomain},
+		{"a.b.bad.example.com.", "*.bad.example.com", rpzNodata},
+		{"OK.bad.example.com.", "ok.bad.example.com", rpzPassthru},
+		{"drop.example.com.", "drop.example.com", rpzDrop},
+		{"garden.example.com.", "garden.example.com", rpzLocal},
+		{"example.com.", "", 0},
+		{"rpz-ip.", "", 0},
+	}
+	for i, tc := range tests {
+		rule := matchName(rules.qname, rules.qnameWildcard, tc.name)
+		got := ""
+		if rule != nil {
+			got = rule.trigger
+			if rule.action != tc.action {
+				t.Errorf("Test %d: expected action %d, got %d", i, tc.action, rule.action)
+			}
+		}
+		if got != tc.expected {
+			t.Errorf("Test %d: expected trigger %q for %s, got %q", i, tc.expected, tc.name, got)
+		}
+	}
+	if rule := rules.ip.match(net.ParseIP("198.51.100.7")); rule == nil {
+		t.Errorf("Expected a rule for 198.51.100.7")
+	}
+	if rule := matchName(rules.nsdname, rules.nsdnameWildcard, "ns.evil.example."); rule == nil {
+		t.Errorf("Expected a rule for name server ns.evil.example")
+	}
+}
+
+func TestCompileRPZMapped(t *testing.T) {
+	rules := loadRPZ(t, "rpz.example.org", `$ORIGIN rpz.example.org.
+@                            300 IN SOA ns.rpz.example.org. admin.rpz.example.org. 1 3600 600 86400 60
+104.0.a00.ffff.zz.rpz-ip     300 IN CNAME .
+128.1.a00.ffff.zz.rpz-client-ip 300 IN CNAME .
+`).current()
+
+	if rules.size != 2 {
+		t.Errorf("Expected 2 rules, got %d", rules.size)
+	}
+	for _, addr := range []string{"10.1.2.3", "::ffff:10.1.2.3"} {
+		if rule := rules.ip.match(net.ParseIP(addr)); rule == nil {
+			t.Errorf("Expected a rule for %s", addr)
+		}
+	}
+	if rule := rules.clientIP.match(net.ParseIP("10.0.0.1")); rule == nil {
+		t.Errorf("Expected a client rule for 10.0.0.1")
+	}
+}
+
+// rpzUpstream answers like a resolver would: example.net is served by
+// ns.evil.example and ip.example.org has an address on an RPZ-IP trigger.
+func rpzUpstream() plugin.Handler {
+	return plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		q := r.Question[0]
+		m := new(dns.Msg)
+		m.SetReply(r)
+		switch q.Qtype {
+		case dns.TypeNS:
+			if q.Name == "example.net." {
+				rr, _ := dns.NewRR("example.net. 300 IN NS ns.evil.example.")
+				m.Answer = append(m.Answer, rr)
+			} else if dns.IsSubDomain("example.net.", q.Name) {
+				rr, _ := dns.NewRR("example.net. 300 IN SOA ns.evil.example. admin.example.net. 1 3600 600 86400 60")
+				m.Ns = append(m.Ns, rr)
+			}
+		case dns.TypeA:
+			addr := "192.0.2.10"
+			if q.Name == "ip.example.org." {
+				addr = "198.51.100.7"
+			}
+			rr, _ := dns.NewRR(q.Name + " 300 IN A " + addr)
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+}
+
+func TestRPZ(t *testing.T) {
+	z := loadRPZ(t, "rpz.example.org", testRPZ)
+
+	tests := []struct {
+		qname          string
+		qtype          uint16
+		expectedRcode  int
+		expectedAnswer []string // as name and type or data, nil for no answer at all
+		expectedReason string
+	}{
+		{"bad.example.com.", dns.TypeA, dns.RcodeNameError, []string{}, "rpz rpz.example.org bad.example.com"},
+		{"x.bad.example.com.", dns.TypeA, dns.RcodeSuccess, []string{}, "rpz rpz.example.org *.bad.example.com"},
+		{"ok.bad.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"ok.bad.example.com. 192.0.2.10"}, ""},
+		{"drop.example.com.", dns.TypeA, 0, nil, "rpz rpz.example.org drop.example.com"},
+		{"garden.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"garden.example.com. 192.0.2.99"}, "rpz rpz.example.org garden.example.com"},
+		{"garden.example.com.", dns.TypeTXT, dns.RcodeSuccess, []string{"garden.example.com. TXT"}, "rpz rpz.example.org garden.example.com"},
+		{"garden.example.com.", dns.TypeAAAA, dns.RcodeSuccess, []string{}, "rpz rpz.example.org garden.example.com"},
+		{"redirect.example.com.", dns.TypeA, dns.RcodeSuccess, []string{"redirect.example.com. CNAME", "walled.example.net. 192.0.2.10"}, "rpz rpz.example.org redirect.example.com"},
+		{"ip.example.org.", dns.TypeA, dns.RcodeNameError, []string{}, "rpz rpz.example.org 24.0.100.51.198.rpz-ip"},
+		{"www.example.net.", dns.TypeA, dns.RcodeNameError, []string{}, "rpz rpz.example.org ns.evil.example.rpz-nsdname"},
+		{"www.example.org.", dns.TypeA, dns.RcodeSuccess, []string{"www.example.org. 192.0.2.10"}, ""},
+	}
+
+	for i, tc := range tests {
+		ut := &Untangle{
+			Next:     rpzUpstream(),
+			rpz:      []*rpzZone{z},
+			policies: singlePolicy(t, "10.240.0.0/16", &policyHolder{}),
+			onError:  errorAllow,
+			pool:     newPool(downDaemon(), 1),
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		ctx := context.WithValue(context.TODO(), decisionKey{}, new(decision))
+		ut.ServeDNS(ctx, rec, m)
+		ut.pool.Stop()
+
+		if d := decisionFrom(ctx); d.reason.text != tc.expectedReason {
+			t.Errorf("Test %d: expected reason %q, got %q", i, tc.expectedReason, d.reason.text)
+		}
+		if tc.expectedAnswer == nil {
+			if rec.Msg != nil {
+				t.Errorf("Test %d: expected no answer, got %v", i, rec.Msg)
+			}
+			continue
+		}
+		if rec.Msg == nil {
+			t.Errorf("Test %d: expected an answer", i)
+			continue
+		}
+		if rec.Msg.Rcode != tc.expectedRcode {
+			t.Errorf("Test %d: expected rcode %d, got %d", i, tc.expectedRcode, rec.Msg.Rcode)
+		}
+		if len(rec.Msg.Answer) != len(tc.expectedAnswer) {
+			t.Errorf("Test %d: expected %d answers, got %v", i, len(tc.expectedAnswer), rec.Msg.Answer)
+			continue
+		}
+		for j, rr := range rec.Msg.Answer {
+			got := rr.Header().Name + " " + dns.TypeToString[rr.Header().Rrtype]
+			switch rr := rr.(type) {
+			case *dns.A:
+				got = rr.Hdr.Name + " " + rr.A.String()
+			}
+			if got != tc.expectedAnswer[j] {
+				t.Errorf("Test %d: expected answer %q, got %q", i, tc.expectedAnswer[j], got)
+			}
+		}
+	}
+}
+
+func TestRPZTCPOnly(t *testing.T) {
+	z := loadRPZ(t, "rpz.example.org", testRPZ)
+
+	for _, tcp := range []bool{false, true} {
+		ut := &Untangle{
+			Next:     rpzUpstream(),
+			rpz:      []*rpzZone{z},
+			policies: singlePolicy(t, "10.240.0.0/16", &policyHolder{}),
+			onError:  errorAllow,
+			pool:     newPool(downDaemon(), 1),
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion("tcp.example.com.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{TCP: tcp})
+		ut.ServeDNS(context.TODO(), rec, m)
+		ut.pool.Stop()
+
+		if rec.Msg == nil {
+			t.Fatalf("Expected an answer over tcp %v", tcp)
+		}
+		if rec.Msg.Truncated == tcp || (len(rec.Msg.Answer) == 0) != !tcp {
+			t.Errorf("Expected a truncated answer over UDP and a full answer over TCP, got %v over tcp %v", rec.Msg, tcp)
+		}
+	}
+}
+
+func TestRPZPrecedence(t *testing.T) {
+	first := loadRPZ(t, "first.rpz", `$ORIGIN first.rpz.
+@ 300 IN SOA ns.first.rpz. admin.first.rpz. 1 3600 600 86400 60
+bad.example.com 300 IN CNAME rpz-passthru.
+32.1.0.240.10.rpz-client-ip 300 IN CNAME *.
+`)
+	second := loadRPZ(t, "second.rpz", `$ORIGIN second.rpz.
+@ 300 IN SOA ns.second.rpz. admin.second.rpz. 1 3600 600 86400 60
+bad.example.com 300 IN CNAME .
+worse.example.com 300 IN CNAME .
+`)
+	ut := &Untangle{rpz: []*rpzZone{first, second}}
+
+	tests := []struct {
+		client   string
+		qname    string
+		expected string // zone and trigger
+	}{
+		// the client trigger comes before the query name in the same zone
+		{"10.240.0.1", "bad.example.com.", "first.rpz 32.1.0.240.10.rpz-client-ip"},
+		// the first zone wins
+		{"10.240.0.2", "bad.example.com.", "first.rpz bad.example.com"},
+		{"10.240.0.2", "worse.example.com.", "second.rpz worse.example.com"},
+		{"10.240.0.2", "good.example.com.", ""},
+	}
+	for i, tc := range tests {
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeA)
+		got := ""
+		if rule := ut.rpzQuery(net.ParseIP(tc.client), tc.qname); rule != nil {
+			got = rule.zone + " " + rule.trigger
+		}
+		if got != tc.expected {
+			t.Errorf("Test %d: expected %q, got %q", i, tc.expected, got)
+		}
+	}
+}
+
+func TestRPZClientID(t *testing.T) {
+	z := loadRPZ(t, "rpz.example.org", `$ORIGIN rpz.example.org.
+@ 300 IN SOA ns.rpz.example.org. admin.rpz.example.org. 1 3600 600 86400 60
+32.7.1.168.192.rpz-client-ip 300 IN CNAME .
+32.1.0.240.10.rpz-client-ip 300 IN CNAME *.
+`)
+	ps := newPolicySet("")
+	site, _ := parsePrefix("10.240.0.0/16")
+	lan, _ := parsePrefix("192.168.1.0/24")
+	ps.table.insert(site, &policyHolder{customerId: "site"})
+	ps.table.insert(lan, &policyHolder{customerId: "lan"})
+	ps.devices["kids-tablet"] = &policyHolder{customerId: "device"}
+
+	// test.ResponseWriter queries come from the forwarder at 10.240.0.1
+	trusted, _ := parsePrefix("10.240.0.1")
+
+	tests := []struct {
+		option        dns.EDNS0
+		expectedRcode int
+		expectedCount int // answers
+	}{
+		// the client behind the forwarder is matched, not the forwarder
+		{&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: net.ParseIP("192.168.1.7").To4()}, dns.RcodeNameError, 0},
+		{&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 32, Address: net.ParseIP("192.168.1.8").To4()}, dns.RcodeSuccess, 1},
+		// a device has no address, the forwarder is matched instead
+		{&dns.EDNS0_LOCAL{Code: defaultMACOption, Data: []byte("kids-tablet")}, dns.RcodeSuccess, 0},
+	}
+
+	for i, tc := range tests {
+		ut := &Untangle{
+			Next:              rpzUpstream(),
+			rpz:               []*rpzZone{z},
+			policies:          ps,
+			identify:          []identifyMethod{identifyECS, identifyMAC},
+			macOption:         defaultMACOption,
+			trustedForwarders: []*net.IPNet{trusted},
+			onError:           errorAllow,
+			pool:              newPool(downDaemon(), 1),
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion("www.example.org.", dns.TypeA)
+		m.SetEdns0(4096, false)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, tc.option)
+
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		ut.ServeDNS(context.TODO(), rec, m)
+		ut.pool.Stop()
+
+		if rec.Msg == nil {
+			t.Fatalf("Test %d: expected an answer", i)
+		}
+		if rec.Msg.Rcode != tc.expectedRcode || len(rec.Msg.Answer) != tc.expectedCount {
+			t.Errorf("Test %d: expected rcode %d with %d answers, got %v", i, tc.expectedRcode, tc.expectedCount, rec.Msg)
+		}
+	}
+}
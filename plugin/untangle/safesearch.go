@@ -0,0 +1,149 @@
+/*
+ * safesearch.go
+ * This is the enforced SafeSearch for the Untangle DNS filter proxy
+ * Search engines offer a safe mode that is forced on at the DNS layer by
+ * answering the names of the engine with a CNAME to its safe endpoint. The
+ * endpoint is resolved through the rest of the plugin chain so the client
+ * gets a complete answer.
+ */
+
+package untangle
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/nonwriter"
+	"github.com/coredns/coredns/request"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/publicsuffix"
+)
+
+// safeSearch is the set of search engines a policy forces into safe mode.
+type safeSearch uint8
+
+const (
+	safeGoogle safeSearch = 1 << iota
+	safeBing
+	safeDuckDuckGo
+	safeYouTube
+	safeYouTubeModerate // moderate instead of strict restricted mode
+
+	safeAll = safeGoogle | safeBing | safeDuckDuckGo | safeYouTube
+)
+
+// safeSearchTTL is the TTL of the CNAME to the safe endpoint.
+const safeSearchTTL = 300
+
+// The safe endpoints of the search engines.
+const (
+	googleSafe      = "forcesafesearch.google.com."
+	bingSafe        = "strict.bing.com."
+	duckDuckGoSafe  = "safe.duckduckgo.com."
+	youTubeStrict   = "restrict.youtube.com."
+	youTubeModerate = "restrictmoderate.youtube.com."
+)
+
+// safeSearchNames are the names rewritten for each engine, except for the
+// country domains of Google which are matched by safeSearch.target.
+var safeSearchNames = map[string]safeSearch{
+	"www.bing.com.":             safeBing,
+	"bing.com.":                 safeBing,
+	"duckduckgo.com.":           safeDuckDuckGo,
+	"www.duckduckgo.com.":       safeDuckDuckGo,
+	"start.duckduckgo.com.":     safeDuckDuckGo,
+	"www.youtube.com.":          safeYouTube,
+	"m.youtube.com.":            safeYouTube,
+	"youtubei.googleapis.com.":  safeYouTube,
+	"youtube.googleapis.com.":   safeYouTube,
+	"www.youtube-nocookie.com.": safeYouTube,
+}
+
+func parseSafeSearchEngine(s string) (safeSearch, error) {
+	switch strings.ToLower(s) {
+	case "google":
+		return safeGoogle, nil
+	case "bing":
+		return safeBing, nil
+	case "duckduckgo":
+		return safeDuckDuckGo, nil
+	case "youtube":
+		return safeYouTube, nil
+	}
+	return 0, fmt.Errorf("unknown search engine %q", s)
+}
+
+func parseYouTubeRestrict(s string) (safeSearch, error) {
+	switch strings.ToLower(s) {
+	case "", "strict":
+		return 0, nil
+	case "moderate":
+		return safeYouTubeModerate, nil
+	}
+	return 0, fmt.Errorf("unknown restricted mode %q", s)
+}
+
+// target returns the safe endpoint name should be rewritten to.
+func (s safeSearch) target(name string) (string, bool) {
+	if s&safeAll == 0 {
+		return "", false
+	}
+	name = strings.ToLower(dns.Fqdn(name))
+
+	switch engine := safeSearchNames[name]; {
+	case engine == 0:
+	case s&engine == 0:
+		return "", false
+	case engine == safeBing:
+		return bingSafe, true
+	case engine == safeDuckDuckGo:
+		return duckDuckGoSafe, true
+	case engine == safeYouTube && s&safeYouTubeModerate != 0:
+		return youTubeModerate, true
+	case engine == safeYouTube:
+		return youTubeStrict, true
+	}
+
+	// google.com, www.google.com and the same names under every country
+	// domain, such as www.google.co.uk
+	if s&safeGoogle != 0 {
+		host := strings.TrimPrefix(strings.TrimSuffix(name, "."), "www.")
+		suffix, icann := publicsuffix.PublicSuffix(host)
+		if icann && host == "google."+suffix {
+			return googleSafe, true
+		}
+	}
+	return "", false
+}
+
+// rewrite answers the query with a CNAME to target, followed by the answer
+// the rest of the chain gives for target.
+func (ut *Untangle) rewrite(ctx context.Context, w dns.ResponseWriter, r *dns.Msg, state request.Request, target string) (int, error) {
+	a := new(dns.Msg)
+	a.SetReply(r)
+	hdr := dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeCNAME, Class: state.QClass(), Ttl: safeSearchTTL}
+	a.Answer = []dns.RR{&dns.CNAME{Hdr: hdr, Target: target}}
+
+	if state.QType() != dns.TypeCNAME {
+		m := r.Copy()
+		m.Question[0].Name = target
+		nw := nonwriter.New(w)
+		rcode, err := plugin.NextOrFailure(ut.Name(), ut.Next, ctx, nw, m)
+		if nw.Msg == nil {
+			// nothing was written, leave the error to the server
+			return rcode, err
+		}
+		a.Rcode = nw.Msg.Rcode
+		a.Truncated = nw.Msg.Truncated
+		a.RecursionAvailable = nw.Msg.RecursionAvailable
+		a.Answer = append(a.Answer, nw.Msg.Answer...)
+		a.Ns = nw.Msg.Ns
+	}
+
+	state.SizeAndDo(a)
+	w.WriteMsg(a)
+	return 0, nil
+}
@@ -0,0 +1,119 @@
+package untangle
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+)
+
+func TestSafeSearchTarget(t *testing.T) {
+	tests := []struct {
+		engines  safeSearch
+		name     string
+		expected string // empty when not rewritten
+	}{
+		{safeAll, "www.google.com.", googleSafe},
+		{safeAll, "google.com.", googleSafe},
+		{safeAll, "WWW.Google.co.uk.", googleSafe},
+		{safeAll, "www.google.de", googleSafe},
+		{safeAll, "mail.google.com.", ""},
+		{safeAll, "forcesafesearch.google.com.", ""},
+		{safeAll, "google.blogspot.com.", ""},
+		{safeAll, "www.bing.com.", bingSafe},
+		{safeAll, "duckduckgo.com.", duckDuckGoSafe},
+		{safeAll, "m.youtube.com.", youTubeStrict},
+		{safeAll | safeYouTubeModerate, "www.youtube.com.", youTubeModerate},
+		{safeAll, "example.org.", ""},
+		{safeYouTube, "www.google.com.", ""},
+		{safeGoogle, "www.youtube.com.", ""},
+		{safeYouTubeModerate, "www.youtube.com.", ""},
+		{0, "www.google.com.", ""},
+	}
+
+	for i, tc := range tests {
+		target, ok := tc.engines.target(tc.name)
+		if ok != (tc.expected != "") || target != tc.expected {
+			t.Errorf("Test %d: expected %s to be rewritten to %q, got %q", i, tc.name, tc.expected, target)
+		}
+	}
+}
+
+// addressHandler answers every A query with addr, as a resolver would for
+// the safe endpoints.
+func addressHandler(addr string) plugin.Handler {
+	return plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.RecursionAvailable = true
+		if r.Question[0].Qtype == dns.TypeA {
+			rr, _ := dns.NewRR(r.Question[0].Name + " 300 IN A " + addr)
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+		return dns.RcodeSuccess, nil
+	})
+}
+
+func TestSafeSearchRewrite(t *testing.T) {
+	block, _ := parseDomain("bing.com")
+	allow, _ := parseDomain("google.com")
+	tests := []struct {
+		qname    string
+		qtype    uint16
+		expected []string // the answer, as name and type or address
+	}{
+		{"www.google.com.", dns.TypeA, []string{"www.google.com. CNAME forcesafesearch.google.com.", "forcesafesearch.google.com. A 216.239.38.120"}},
+		{"www.youtube.com.", dns.TypeAAAA, []string{"www.youtube.com. CNAME restrict.youtube.com."}},
+		{"www.youtube.com.", dns.TypeCNAME, []string{"www.youtube.com. CNAME restrict.youtube.com."}},
+		{"www.bing.com.", dns.TypeA, nil}, // blocked by the policy
+		{"www.example.org.", dns.TypeA, []string{"www.example.org. A 216.239.38.120"}},
+	}
+
+	for i, tc := range tests {
+		ut := &Untangle{
+			Next: addressHandler("216.239.38.120"),
+			policies: singlePolicy(t, "10.240.0.0/16", &policyHolder{
+				action:       blockNxdomain,
+				safeSearch:   safeAll,
+				allowDomains: domainList{allow},
+				blockDomains: domainList{block},
+			}),
+			onError: errorAllow,
+			pool:    newPool(downDaemon(), 1),
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		ut.ServeDNS(context.TODO(), rec, m)
+		ut.pool.Stop()
+
+		if rec.Msg == nil {
+			t.Fatalf("Test %d: expected an answer", i)
+		}
+		if len(rec.Msg.Answer) != len(tc.expected) {
+			t.Errorf("Test %d: expected %d answers, got %v", i, len(tc.expected), rec.Msg.Answer)
+			continue
+		}
+		for j, rr := range rec.Msg.Answer {
+			var got string
+			switch rr := rr.(type) {
+			case *dns.CNAME:
+				got = rr.Hdr.Name + " CNAME " + rr.Target
+			case *dns.A:
+				got = rr.Hdr.Name + " A " + rr.A.String()
+			}
+			if got != tc.expected[j] {
+				t.Errorf("Test %d: expected answer %q, got %q", i, tc.expected[j], got)
+			}
+		}
+		if rec.Msg.Question[0].Name != tc.qname {
+			t.Errorf("Test %d: expected question %s, got %s", i, tc.qname, rec.Msg.Question[0].Name)
+		}
+	}
+}
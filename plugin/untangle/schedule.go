@@ -0,0 +1,126 @@
+/*
+ * schedule.go
+ * This is the policy schedule logic for the Untangle DNS filter proxy
+ * A policy may carry schedules that switch the categories and reputation
+ * it blocks during certain hours, such as blocking games and social media
+ * during school or office hours only.
+ */
+
+package untangle
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Schedule is a time window in which other block settings apply.
+type Schedule struct {
+	Days            []string `json:"days,omitempty"`
+	Start           string   `json:"start,omitempty"`
+	End             string   `json:"end,omitempty"`
+	Timezone        string   `json:"timezone,omitempty"`
+	BlockCategories []int    `json:"blockCategories,omitempty"`
+	BlockReputation int      `json:"blockReputation,omitempty"`
+}
+
+// schedule is a compiled Schedule. Start and end are minutes since
+// midnight, when end is before start the window runs past midnight.
+type schedule struct {
+	days              [7]bool
+	start, end        int
+	loc               *time.Location
+	minimumReputation int
+	blockCategories   []int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// compileSchedule checks s and turns it into a schedule, path names s in errors.
+func compileSchedule(path string, s Schedule) (*schedule, []error) {
+	var errs []error
+	sc := &schedule{
+		minimumReputation: s.BlockReputation,
+		blockCategories:   append([]int(nil), s.BlockCategories...),
+		loc:               time.Local,
+	}
+
+	// no days means every day
+	for i := range sc.days {
+		sc.days[i] = len(s.Days) == 0
+	}
+	for j, day := range s.Days {
+		wd, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s.days[%d]: unknown day %q", path, j, day))
+			continue
+		}
+		sc.days[wd] = true
+	}
+
+	var err error
+	if sc.start, err = parseClock(s.Start); err != nil {
+		errs = append(errs, fmt.Errorf("%s.start: %v", path, err))
+	}
+	if sc.end, err = parseClock(s.End); err != nil {
+		errs = append(errs, fmt.Errorf("%s.end: %v", path, err))
+	}
+	if s.Timezone != "" {
+		if sc.loc, err = time.LoadLocation(s.Timezone); err != nil {
+			errs = append(errs, fmt.Errorf("%s.timezone: unknown time zone %q", path, s.Timezone))
+		}
+	}
+	return sc, errs
+}
+
+// parseClock parses a HH:MM time of day into minutes since midnight. An
+// empty string is midnight.
+func parseClock(s string) (int, error) {
+	if s == "" {
+		return 0, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// active reports if now falls in the schedule. A window with the same start
+// and end lasts the whole day.
+func (sc *schedule) active(now time.Time) bool {
+	now = now.In(sc.loc)
+	day := now.Weekday()
+	minute := now.Hour()*60 + now.Minute()
+
+	switch {
+	case sc.start == sc.end:
+		return sc.days[day]
+	case sc.start < sc.end:
+		return sc.days[day] && minute >= sc.start && minute < sc.end
+	}
+	// the window started the day before
+	if minute < sc.end {
+		return sc.days[(day+6)%7]
+	}
+	return sc.days[day] && minute >= sc.start
+}
+
+// rules returns the reputation threshold and categories the policy blocks
+// at now: those of the first active schedule, or the policy's own.
+func (p *policyHolder) rules(now time.Time) (int, []int) {
+	for _, sc := range p.schedules {
+		if sc.active(now) {
+			return sc.minimumReputation, sc.blockCategories
+		}
+	}
+	return p.minimumReputation, p.blockCategories
+}
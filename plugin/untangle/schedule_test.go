@@ -0,0 +1,67 @@
+package untangle
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleActive(t *testing.T) {
+	tests := []struct {
+		schedule Schedule
+		now      string // in UTC, 2019-11-04 is a Monday
+		expected bool
+	}{
+		{Schedule{Days: []string{"mon"}, Start: "08:00", End: "16:00"}, "2019-11-04T07:59:00Z", false},
+		{Schedule{Days: []string{"mon"}, Start: "08:00", End: "16:00"}, "2019-11-04T08:00:00Z", true},
+		{Schedule{Days: []string{"mon"}, Start: "08:00", End: "16:00"}, "2019-11-04T16:00:00Z", false},
+		{Schedule{Days: []string{"tue"}, Start: "08:00", End: "16:00"}, "2019-11-04T12:00:00Z", false},
+		{Schedule{Start: "08:00", End: "16:00"}, "2019-11-09T12:00:00Z", true},
+		{Schedule{Days: []string{"Mon"}}, "2019-11-04T23:59:00Z", true},
+		// past midnight, the window belongs to the day it starts
+		{Schedule{Days: []string{"mon"}, Start: "22:00", End: "06:00"}, "2019-11-04T23:00:00Z", true},
+		{Schedule{Days: []string{"mon"}, Start: "22:00", End: "06:00"}, "2019-11-05T05:00:00Z", true},
+		{Schedule{Days: []string{"mon"}, Start: "22:00", End: "06:00"}, "2019-11-04T05:00:00Z", false},
+		{Schedule{Days: []string{"sat"}, Start: "22:00", End: "06:00"}, "2019-11-03T05:00:00Z", true},
+		// 08:00 in Amsterdam is 07:00 UTC in November
+		{Schedule{Start: "08:00", End: "16:00", Timezone: "Europe/Amsterdam"}, "2019-11-04T07:30:00Z", true},
+		{Schedule{Start: "08:00", End: "16:00", Timezone: "Europe/Amsterdam"}, "2019-11-04T15:30:00Z", false},
+	}
+
+	for i, tc := range tests {
+		tc.schedule.Timezone = timezone(tc.schedule.Timezone)
+		sc, errs := compileSchedule("schedule", tc.schedule)
+		if len(errs) > 0 {
+			t.Fatalf("Test %d: %v", i, errs)
+		}
+		now, _ := time.Parse(time.RFC3339, tc.now)
+		if got := sc.active(now); got != tc.expected {
+			t.Errorf("Test %d: expected active %t at %s, got %t", i, tc.expected, tc.now, got)
+		}
+	}
+}
+
+// timezone returns tz, or UTC when tz is empty.
+func timezone(tz string) string {
+	if tz == "" {
+		return "UTC"
+	}
+	return tz
+}
+
+func TestPolicyRules(t *testing.T) {
+	sc, _ := compileSchedule("schedule", Schedule{Days: []string{"mon"}, Start: "08:00", End: "16:00", Timezone: "UTC", BlockCategories: []int{11}, BlockReputation: 40})
+	p := &policyHolder{minimumReputation: 20, blockCategories: []int{7}, schedules: []*schedule{sc}}
+
+	filter := &Response{Reputation: 30, Cats: []Category{{Catid: 11}}}
+	monday := time.Date(2019, 11, 4, 9, 0, 0, 0, time.UTC)
+
+	if _, blocked := checkPolicy("example.org.", "10.0.0.1", p, filter, monday); !blocked {
+		t.Errorf("Expected the schedule to block during the window")
+	}
+	if _, blocked := checkPolicy("example.org.", "10.0.0.1", p, filter, monday.Add(8*time.Hour)); blocked {
+		t.Errorf("Expected the policy to allow outside the window")
+	}
+	if reason, _ := checkPolicy("example.org.", "10.0.0.1", p, &Response{Reputation: 30}, monday); reason.text != "reputation 30 is below 40" {
+		t.Errorf("Expected the schedule reputation to apply, got %q", reason)
+	}
+}
@@ -0,0 +1,34 @@
+//+build ignore
+
+// generates plugin/untangle/zschema.go from schema.json.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+)
+
+func main() {
+	schema, err := ioutil.ReadFile("schema.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if strings.Contains(string(schema), "`") {
+		log.Fatal("schema.json can't contain a backquote")
+	}
+
+	gofile := fmt.Sprintf(`// Code generated by schema_generate.go; DO NOT EDIT.
+
+package untangle
+
+// policySchema is the content of schema.json.
+const policySchema = %s%s%s
+`, "`", schema, "`")
+
+	if err := ioutil.WriteFile("zschema.go", []byte(gofile), 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -1,61 +1,702 @@
 /*
  * setup.go
  * This is the plugin setup file for the Untangle DNS filter proxy
- * We get the filter daemon address and port from the Corefile args
- * and then hook our plugin into the DNS procesing chain.
+ * We get the filter daemon address, block addresses and other settings
+ * from the Corefile and then hook our plugin into the DNS procesing chain.
  */
 
 package untangle
 
 import (
+	"net"
+	"net/url"
+	"os"
 	"strconv"
-	"sync"
+	"strings"
+	"time"
 
 	"github.com/coredns/coredns/core/dnsserver"
+	"github.com/coredns/coredns/coremain"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
 	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/plugin/pkg/singleflight"
 
 	"github.com/caddyserver/caddy"
+	"github.com/miekg/dns"
 )
 
-var (
-	once sync.Once
-)
-
-func init() { plugin.Register("untangle", setup) }
+func init() {
+	plugin.Register("untangle", setup)
+	coremain.PolicyValidator = ValidatePolicyFile
+}
 
 func setup(c *caddy.Controller) error {
-	addr, port, err := parse(c)
+	ut, err := parse(c)
 	if err != nil {
 		return plugin.Error("untangle", err)
 	}
 
-	// initialize the policy stuff
-	initializePolicy()
+	// load the policies, a bad file is logged and skipped
+	ut.policies = newPolicySet(ut.policyDir)
+	ut.policies.lists = make(map[string]int)
+	for _, bl := range ut.blocklists {
+		ut.policies.lists[bl.name] = bl.category
+	}
+	for _, err := range ut.policies.load() {
+		log.Errorf("%v\n", err)
+	}
+
+	ut.pool = newPool(net.JoinHostPort(ut.DaemonAddress, strconv.Itoa(ut.DaemonPort)), ut.maxConns)
+	ut.pool.hcInterval = ut.hcInterval
+	ut.pool.timeout = ut.timeout
+	if ut.timeout < ut.pool.dialTimeout {
+		ut.pool.dialTimeout = ut.timeout
+	}
+	if ut.classifier == nil {
+		ut.classifier = &brightcloud{pool: ut.pool}
+	}
+	if ut.batchWindow > 0 {
+		ut.batch = newBatcher(ut.batchWindow, ut.batchMax, ut.classify)
+	}
 
 	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-		return Untangle{Next: next, DaemonAddress: addr, DaemonPort: port}
+		ut.Next = next
+		return ut
 	})
 
-	once.Do(func() {
-		caddy.RegisterEventHook("untangle", hook)
+	c.OnStartup(func() error {
+		metrics.MustRegister(c, QueryCount, AllowCount, BlockCount, LookupDuration, LookupFailureCount,
+			EventDropCount, PolicyLoadCount, PolicyCount, PolicyVersion, BlocklistLoadCount, BlocklistEntries,
+			RPZLoadCount, RPZRuleCount)
+		if _, ok := ut.classifier.(*brightcloud); ok {
+			ut.pool.Start()
+		}
+		if ut.events != nil {
+			ut.events.Start()
+		}
+		for _, bl := range ut.blocklists {
+			bl.Start()
+		}
+		for _, z := range ut.rpz {
+			z.Start()
+		}
+		if ut.reload > 0 {
+			ut.policies.watch(ut.reload)
+		}
+		return nil
+	})
+
+	c.OnShutdown(func() error {
+		ut.pool.Stop()
+		ut.policies.stopWatch()
+		for _, bl := range ut.blocklists {
+			bl.Stop()
+		}
+		for _, z := range ut.rpz {
+			z.Stop()
+		}
+		if ut.events != nil {
+			ut.events.Stop()
+		}
+		return nil
 	})
 
+	// the admin API is closed before a restart starts the new instance, which
+	// listens on the same address, and opened again if the restart fails
+	if ut.admin != nil {
+		c.OnStartup(ut.admin.Start)
+		c.OnRestart(ut.admin.Stop)
+		c.OnFinalShutdown(ut.admin.Stop)
+		c.OnRestartFailed(ut.admin.Start)
+	}
+
 	return nil
 }
 
-func parse(c *caddy.Controller) (string, int, error) {
+func parse(c *caddy.Controller) (*Untangle, error) {
+	ut := &Untangle{
+		DaemonAddress: "127.0.0.1",
+		DaemonPort:    8484,
+		policyDir:     defaultPolicyDir,
+		reload:        defaultReloadDelay,
+		maxConns:      defaultMaxConns,
+		hcInterval:    defaultHealthCheck,
+		timeout:       defaultTimeout,
+		onError:       errorAllow,
+		breaker:       newBreaker(defaultBreakerFails, defaultBreakerCooldown),
+		inflight:      new(singleflight.Group),
+		macOption:     defaultMACOption,
+	}
+	vc := newVerdictCache()
+	el := newEventLog("")
+
+	i := 0
 	for c.Next() {
+		if i > 0 {
+			return nil, plugin.ErrOnce
+		}
+		i++
+
+		// the legacy form gives the daemon and block addresses as arguments
+		args := c.RemainingArgs()
+		switch len(args) {
+		case 0:
+		case 2, 4:
+			port, err := parsePort(c, args[1])
+			if err != nil {
+				return nil, err
+			}
+			ut.DaemonAddress, ut.DaemonPort = args[0], port
+			if len(args) == 4 {
+				if ut.block4, err = parseBlockAddress(c, args[2], true); err != nil {
+					return nil, err
+				}
+				if ut.block6, err = parseBlockAddress(c, args[3], false); err != nil {
+					return nil, err
+				}
+			}
+		default:
+			return nil, c.ArgErr()
+		}
+
+		for c.NextBlock() {
+			if err := parseBlock(c, ut, vc, el); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(ut.identify) > 0 && len(ut.trustedForwarders) == 0 {
+		return nil, c.Errf("client_id needs trusted_forwarders")
+	}
+
+	// the timeout may come after the classifier
+	if hc, ok := ut.classifier.(*httpClassifier); ok {
+		hc.client.Timeout = ut.timeout
+	}
+
+	if vc.cap > 0 {
+		vc.init()
+		ut.cache = vc
+	}
+
+	if el.dest != "" {
+		ut.events = el
+	} else if el.maxSize > 0 || el.sample != 100 {
+		return nil, c.Errf("events_rotate and events_sample need an events destination")
+	}
+
+	return ut, nil
+}
+
+func parseBlock(c *caddy.Controller, ut *Untangle, vc *verdictCache, el *eventLog) error {
+	switch c.Val() {
+	case "daemon":
+		arg, err := singleArg(c)
+		if err != nil {
+			return err
+		}
+		host, port, err := net.SplitHostPort(arg)
+		if err != nil {
+			return c.Errf("invalid daemon address '%s': %v", arg, err)
+		}
+		if host == "" {
+			return c.Errf("invalid daemon address '%s': missing host", arg)
+		}
+		n, err := parsePort(c, port)
+		if err != nil {
+			return err
+		}
+		ut.DaemonAddress, ut.DaemonPort = host, n
+	case "policy_dir":
+		arg, err := singleArg(c)
+		if err != nil {
+			return err
+		}
+		ut.policyDir = arg
+	case "reload":
+		arg, err := singleArg(c)
+		if err != nil {
+			return err
+		}
+		dur, err := time.ParseDuration(arg)
+		if err != nil {
+			return c.Errf("invalid duration '%s'", arg)
+		}
+		if dur < 0 {
+			return c.Errf("reload can't be negative: %s", dur)
+		}
+		ut.reload = dur
+	case "block_ipv4":
+		arg, err := singleArg(c)
+		if err != nil {
+			return err
+		}
+		ip, err := parseBlockAddress(c, arg, true)
+		if err != nil {
+			return err
+		}
+		ut.block4 = ip
+	case "block_ipv6":
+		arg, err := singleArg(c)
+		if err != nil {
+			return err
+		}
+		ip, err := parseBlockAddress(c, arg, false)
+		if err != nil {
+			return err
+		}
+		ut.block6 = ip
+	case "max_conns":
+		arg, err := singleArg(c)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return c.Errf("invalid number '%s'", arg)
+		}
+		if n <= 0 {
+			return c.Errf("max_conns must be positive: %d", n)
+		}
+		ut.maxConns = n
+	case "health_check":
+		arg, err := singleArg(c)
+		if err != nil {
+			return err
+		}
+		dur, err := time.ParseDuration(arg)
+		if err != nil {
+			return c.Errf("invalid duration '%s'", arg)
+		}
+		if dur < 0 {
+			return c.Errf("health_check can't be negative: %s", dur)
+		}
+		ut.hcInterval = dur
+	case "timeout":
+		arg, err := singleArg(c)
+		if err != nil {
+			return err
+		}
+		dur, err := time.ParseDuration(arg)
+		if err != nil {
+			return c.Errf("invalid duration '%s'", arg)
+		}
+		if dur <= 0 {
+			return c.Errf("timeout must be positive: %s", dur)
+		}
+		ut.timeout = dur
+	case "on_error":
+		arg, err := singleArg(c)
+		if err != nil {
+			return err
+		}
+		action, err := parseErrorAction(arg)
+		if err != nil || action == errorDefault {
+			return c.Errf("on_error must be one of allow, block or servfail: '%s'", arg)
+		}
+		ut.onError = action
+	case "inspect_answers":
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		ut.inspect = true
+	case "admin":
+		args := c.RemainingArgs()
+		addr := defaultAdminAddress
+		switch len(args) {
+		case 0:
+		case 1:
+			addr = args[0]
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return c.Errf("invalid admin address '%s'", addr)
+			}
+		default:
+			return c.ArgErr()
+		}
+		if err := claimAdminAddress(c, addr); err != nil {
+			return err
+		}
+		ut.admin = newAdmin(addr, ut)
+	case "events":
+		arg, err := singleArg(c)
+		if err != nil {
+			return err
+		}
+		if err := parseEventDest(arg); err != nil {
+			return c.Errf("invalid events destination '%s': %v", arg, err)
+		}
+		el.dest = arg
+	case "events_rotate":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		size, err := strconv.Atoi(args[0])
+		if err != nil {
+			return c.Errf("invalid number '%s'", args[0])
+		}
+		if size <= 0 {
+			return c.Errf("events_rotate size must be positive: %d", size)
+		}
+		el.maxSize = int64(size) << 20
+		if len(args) > 1 {
+			keep, err := strconv.Atoi(args[1])
+			if err != nil {
+				return c.Errf("invalid number '%s'", args[1])
+			}
+			if keep < 0 {
+				return c.Errf("events_rotate keep can't be negative: %d", keep)
+			}
+			el.keep = keep
+		}
+	case "events_sample":
+		pct, err := singleArg(c)
+		if err != nil {
+			return err
+		}
+		if len(pct) == 0 {
+			return c.ArgErr()
+		}
+		if x := pct[len(pct)-1]; x != '%' {
+			return c.Errf("last character of percentage should be `%%`, but is: %q", x)
+		}
+		num, err := strconv.Atoi(pct[:len(pct)-1])
+		if err != nil {
+			return c.Errf("invalid percentage '%s'", pct)
+		}
+		if num < 0 || num > 100 {
+			return c.Errf("percentage should fall in range [0, 100]: %d", num)
+		}
+		el.sample = num
+	case "classifier":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		switch args[0] {
+		case "brightcloud":
+			if len(args) != 1 {
+				return c.ArgErr()
+			}
+			ut.classifier = nil
+		case "file":
+			if len(args) != 2 {
+				return c.ArgErr()
+			}
+			cf, err := newCategoryFile(args[1])
+			if err != nil {
+				return c.Errf("unable to read category file: %v", err)
+			}
+			ut.classifier = cf
+		case "http":
+			if len(args) != 2 {
+				return c.ArgErr()
+			}
+			u, err := url.Parse(args[1])
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return c.Errf("invalid classifier url '%s'", args[1])
+			}
+			ut.classifier = newHTTPClassifier(args[1], defaultTimeout)
+		default:
+			return c.Errf("unknown classifier '%s'", args[0])
+		}
+	case "blocklist":
+		args := c.RemainingArgs()
+		if len(args) < 2 || len(args) > 3 {
+			return c.ArgErr()
+		}
+		for _, bl := range ut.blocklists {
+			if bl.name == args[0] {
+				return c.Errf("duplicate blocklist '%s'", args[0])
+			}
+		}
+		if isURL(args[1]) {
+			if u, err := url.Parse(args[1]); err != nil || u.Host == "" {
+				return c.Errf("invalid blocklist url '%s'", args[1])
+			}
+		} else if _, err := os.Stat(args[1]); err != nil {
+			return c.Errf("unable to read blocklist: %v", err)
+		}
+		bl := newBlocklist(args[0], args[1], blocklistCategoryBase+len(ut.blocklists)+1)
+		if len(args) == 3 {
+			refresh, err := time.ParseDuration(args[2])
+			if err != nil {
+				return c.Errf("invalid duration '%s'", args[2])
+			}
+			if refresh <= 0 {
+				return c.Errf("blocklist refresh must be positive: %s", refresh)
+			}
+			bl.refresh = refresh
+		}
+		ut.blocklists = append(ut.blocklists, bl)
+	case "rpz":
+		args := c.RemainingArgs()
+		if len(args) < 3 {
+			return c.ArgErr()
+		}
+		origin := args[0]
+		if _, ok := dns.IsDomainName(origin); !ok {
+			return c.Errf("invalid rpz zone '%s'", origin)
+		}
+		for _, z := range ut.rpz {
+			if z.origin == dns.Fqdn(strings.ToLower(origin)) {
+				return c.Errf("duplicate rpz zone '%s'", origin)
+			}
+		}
+		var z *rpzZone
+		switch args[1] {
+		case "file":
+			if len(args) > 4 {
+				return c.ArgErr()
+			}
+			if _, err := os.Stat(args[2]); err != nil {
+				return c.Errf("unable to read rpz zone: %v", err)
+			}
+			z = newRPZFile(origin, args[2])
+			if len(args) == 4 {
+				refresh, err := time.ParseDuration(args[3])
+				if err != nil {
+					return c.Errf("invalid duration '%s'", args[3])
+				}
+				if refresh <= 0 {
+					return c.Errf("rpz refresh must be positive: %s", refresh)
+				}
+				z.refresh = refresh
+			}
+		case "primary":
+			var primaries []string
+			for _, arg := range args[2:] {
+				addr := arg
+				if _, _, err := net.SplitHostPort(arg); err != nil {
+					addr = net.JoinHostPort(arg, "53")
+				}
+				if host, _, _ := net.SplitHostPort(addr); net.ParseIP(host) == nil {
+					return c.Errf("invalid rpz primary '%s'", arg)
+				}
+				primaries = append(primaries, addr)
+			}
+			z = newRPZPrimary(origin, primaries)
+		default:
+			return c.Errf("rpz source must be file or primary: '%s'", args[1])
+		}
+		ut.rpz = append(ut.rpz, z)
+	case "client_id":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		ut.identify = nil
+		for _, arg := range args {
+			switch arg {
+			case "ecs":
+				ut.identify = append(ut.identify, identifyECS)
+			case "mac":
+				ut.identify = append(ut.identify, identifyMAC)
+			default:
+				return c.Errf("client_id must be ecs or mac: '%s'", arg)
+			}
+		}
+	case "mac_option":
+		arg, err := singleArg(c)
+		if err != nil {
+			return err
+		}
+		code, err := strconv.ParseUint(arg, 10, 16)
+		if err != nil {
+			return c.Errf("invalid EDNS0 option code '%s'", arg)
+		}
+		ut.macOption = uint16(code)
+	case "trusted_forwarders":
+		args := c.RemainingArgs()
+		if len(args) == 0 {
+			return c.ArgErr()
+		}
+		for _, arg := range args {
+			n, err := parsePrefix(arg)
+			if err != nil {
+				return c.Errf("invalid trusted forwarder '%s'", arg)
+			}
+			ut.trustedForwarders = append(ut.trustedForwarders, n)
+		}
+	case "parent_fallback":
+		if len(c.RemainingArgs()) != 0 {
+			return c.ArgErr()
+		}
+		ut.parentFallback = true
+	case "batch":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		window, err := time.ParseDuration(args[0])
+		if err != nil {
+			return c.Errf("invalid duration '%s'", args[0])
+		}
+		if window < 0 {
+			return c.Errf("batch window can't be negative: %s", window)
+		}
+		ut.batchWindow, ut.batchMax = window, defaultBatchMax
+		if len(args) > 1 {
+			max, err := strconv.Atoi(args[1])
+			if err != nil {
+				return c.Errf("invalid number '%s'", args[1])
+			}
+			if max <= 0 {
+				return c.Errf("batch size must be positive: %d", max)
+			}
+			ut.batchMax = max
+		}
+	case "breaker":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return c.ArgErr()
+		}
+		fails, err := strconv.Atoi(args[0])
+		if err != nil {
+			return c.Errf("invalid number '%s'", args[0])
+		}
+		if fails < 0 {
+			return c.Errf("breaker failures can't be negative: %d", fails)
+		}
+		ut.breaker.threshold = fails
+		if len(args) > 1 {
+			dur, err := time.ParseDuration(args[1])
+			if err != nil {
+				return c.Errf("invalid duration '%s'", args[1])
+			}
+			if dur <= 0 {
+				return c.Errf("breaker cooldown must be positive: %s", dur)
+			}
+			ut.breaker.cooldown = dur
+		}
+	case "cache":
+		args := c.RemainingArgs()
+		if len(args) == 0 || len(args) > 3 {
+			return c.ArgErr()
+		}
+		capacity, err := strconv.Atoi(args[0])
+		if err != nil {
+			return c.Errf("invalid number '%s'", args[0])
+		}
+		if capacity < 0 {
+			return c.Errf("cache capacity can't be negative: %d", capacity)
+		}
+		vc.cap = capacity
+		if len(args) > 1 {
+			if vc.ttl, err = parseTTL(c, args[1]); err != nil {
+				return err
+			}
+		}
+		if len(args) > 2 {
+			if vc.nttl, err = parseTTL(c, args[2]); err != nil {
+				return err
+			}
+		}
+	case "prefetch":
 		args := c.RemainingArgs()
-		if len(args) != 4 {
-			log.Warningf("Invalid arguments. Using defaults\n")
-			return "127.0.0.1", 8484, nil
+		if len(args) == 0 || len(args) > 3 {
+			return c.ArgErr()
+		}
+		amount, err := strconv.Atoi(args[0])
+		if err != nil {
+			return c.Errf("invalid number '%s'", args[0])
+		}
+		if amount < 0 {
+			return c.Errf("prefetch amount should be positive: %d", amount)
+		}
+		vc.prefetch = amount
+		if len(args) > 1 {
+			dur, err := time.ParseDuration(args[1])
+			if err != nil {
+				return c.Errf("invalid duration '%s'", args[1])
+			}
+			vc.duration = dur
+		}
+		if len(args) > 2 {
+			pct := args[2]
+			if len(pct) == 0 {
+				return c.ArgErr()
+			}
+			if x := pct[len(pct)-1]; x != '%' {
+				return c.Errf("last character of percentage should be `%%`, but is: %q", x)
+			}
+			num, err := strconv.Atoi(pct[:len(pct)-1])
+			if err != nil {
+				return c.Errf("invalid percentage '%s'", pct)
+			}
+			if num < 10 || num > 90 {
+				return c.Errf("percentage should fall in range [10, 90]: %d", num)
+			}
+			vc.percentage = num
 		}
-		port, _ := strconv.Atoi(args[1])
-		log.Debugf("ADDR:%v PORT:%v BLOCK4:%v BLOCK6:%v\n", args[0], port, args[2], args[3])
-		return args[0], port, nil
+	default:
+		return c.Errf("unknown property '%s'", c.Val())
+	}
+	return nil
+}
+
+// singleArg returns the one argument of the current property.
+func singleArg(c *caddy.Controller) (string, error) {
+	args := c.RemainingArgs()
+	if len(args) != 1 {
+		return "", c.ArgErr()
 	}
+	return args[0], nil
+}
+
+// parsePort parses a daemon TCP port.
+func parsePort(c *caddy.Controller, arg string) (int, error) {
+	port, err := strconv.Atoi(arg)
+	if err != nil || port <= 0 || port > 65535 {
+		return 0, c.Errf("invalid daemon port '%s'", arg)
+	}
+	return port, nil
+}
+
+// adminAddrsKey keys the admin addresses of the server blocks in the storage
+// of the caddy instance, so a reload doesn't see those of the old instance.
+type adminAddrsKey struct{}
+
+// claimAdminAddress takes addr for the admin API of this server block, two
+// blocks can't listen on the same address.
+func claimAdminAddress(c *caddy.Controller, addr string) error {
+	taken, _ := c.Get(adminAddrsKey{}).(map[string]bool)
+	if taken == nil {
+		taken = make(map[string]bool)
+		c.Set(adminAddrsKey{}, taken)
+	}
+	if taken[addr] {
+		return c.Errf("admin address '%s' is already used by another server block", addr)
+	}
+	taken[addr] = true
+	return nil
+}
 
-	log.Warningf("Missing arguments. Using defaults\n")
-	return "127.0.0.1", 8484, nil
+// parseBlockAddress parses the IPv4 or IPv6 address of the block server.
+func parseBlockAddress(c *caddy.Controller, arg string, v4 bool) (net.IP, error) {
+	ip := net.ParseIP(arg)
+	if ip == nil {
+		return nil, c.Errf("invalid block address '%s'", arg)
+	}
+	if v4 && ip.To4() == nil {
+		return nil, c.Errf("block address '%s' is not an IPv4 address", arg)
+	}
+	if !v4 && ip.To4() != nil {
+		return nil, c.Errf("block address '%s' is not an IPv6 address", arg)
+	}
+	return ip, nil
+}
+
+// parseTTL parses a cache TTL duration.
+func parseTTL(c *caddy.Controller, arg string) (time.Duration, error) {
+	dur, err := time.ParseDuration(arg)
+	if err != nil {
+		return 0, c.Errf("invalid duration '%s'", arg)
+	}
+	if dur < 0 {
+		return 0, c.Errf("cache ttl can't be negative: %s", dur)
+	}
+	return dur, nil
 }
@@ -0,0 +1,696 @@
+package untangle
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/caddyfile"
+)
+
+func TestSetup(t *testing.T) {
+	tests := []struct {
+		input              string
+		shouldErr          bool
+		expectedAddress    string
+		expectedPort       int
+		expectedMaxConns   int
+		expectedHealth     time.Duration
+		expectedErrContent string
+	}{
+		{`untangle 192.168.1.200 8484 192.168.1.1 fe80::1`, false, "192.168.1.200", 8484, defaultMaxConns, defaultHealthCheck, ""},
+		{`untangle 192.168.1.200 8484 192.168.1.1 fe80::1 {
+			max_conns 16
+			health_check 1s
+		}`, false, "192.168.1.200", 8484, 16, time.Second, ""},
+		{`untangle 192.168.1.200 8484 192.168.1.1 fe80::1 {
+			max_conns 0
+		}`, true, "", 0, 0, 0, "max_conns must be positive"},
+		{`untangle 192.168.1.200 8484 192.168.1.1 fe80::1 {
+			health_check -1s
+		}`, true, "", 0, 0, 0, "can't be negative"},
+		{`untangle 192.168.1.200 8484 192.168.1.1 fe80::1 {
+			bogus
+		}`, true, "", 0, 0, 0, "unknown property"},
+		{`untangle`, false, "127.0.0.1", 8484, defaultMaxConns, defaultHealthCheck, ""},
+		{`untangle 192.168.1.200 8485`, false, "192.168.1.200", 8485, defaultMaxConns, defaultHealthCheck, ""},
+		{`untangle {
+			daemon 192.168.1.200:8485
+		}`, false, "192.168.1.200", 8485, defaultMaxConns, defaultHealthCheck, ""},
+		{`untangle {
+			daemon [fd00::1]:8485
+		}`, false, "fd00::1", 8485, defaultMaxConns, defaultHealthCheck, ""},
+		{`untangle 192.168.1.200`, true, "", 0, 0, 0, "Wrong argument count"},
+		{`untangle 192.168.1.200 port`, true, "", 0, 0, 0, "invalid daemon port"},
+		{`untangle 192.168.1.200 8484 192.168.1.1 192.168.1.2`, true, "", 0, 0, 0, "not an IPv6 address"},
+		{`untangle 192.168.1.200 8484 fe80::1 fe80::1`, true, "", 0, 0, 0, "not an IPv4 address"},
+		{`untangle {
+			daemon 192.168.1.200
+		}`, true, "", 0, 0, 0, "invalid daemon address"},
+		{`untangle {
+			daemon 192.168.1.200:99999
+		}`, true, "", 0, 0, 0, "invalid daemon port"},
+		{`untangle {
+			block_ipv4 192.168.1
+		}`, true, "", 0, 0, 0, "invalid block address"},
+		{`untangle {
+			max_conns four
+		}`, true, "", 0, 0, 0, "invalid number"},
+		{`untangle {
+			timeout 2
+		}`, true, "", 0, 0, 0, "invalid duration"},
+		{`untangle {
+			policy_dir /etc/dnsproxy /tmp
+		}`, true, "", 0, 0, 0, "Wrong argument count"},
+		{`untangle
+		untangle`, true, "", 0, 0, 0, "used once"},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		ut, err := parse(c)
+
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+				continue
+			}
+			if !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error but found one for input %s: %v", i, test.input, err)
+			continue
+		}
+		if ut.DaemonAddress != test.expectedAddress || ut.DaemonPort != test.expectedPort {
+			t.Errorf("Test %d: expected daemon %s:%d, got %s:%d", i, test.expectedAddress, test.expectedPort, ut.DaemonAddress, ut.DaemonPort)
+		}
+		if ut.maxConns != test.expectedMaxConns {
+			t.Errorf("Test %d: expected max_conns %d, got %d", i, test.expectedMaxConns, ut.maxConns)
+		}
+		if ut.hcInterval != test.expectedHealth {
+			t.Errorf("Test %d: expected health_check %s, got %s", i, test.expectedHealth, ut.hcInterval)
+		}
+	}
+}
+
+func TestSetupCache(t *testing.T) {
+	tests := []struct {
+		input              string
+		shouldErr          bool
+		expectedCap        int
+		expectedTTL        time.Duration
+		expectedNTTL       time.Duration
+		expectedPrefetch   int
+		expectedPercentage int
+	}{
+		{`untangle 127.0.0.1 8484 192.168.1.1 fe80::1`, false, defaultCacheCap, defaultCacheTTL, defaultCacheNTTL, 0, 10},
+		{`untangle 127.0.0.1 8484 192.168.1.1 fe80::1 {
+			cache 500 10m 30s
+			prefetch 5 2m 20%
+		}`, false, 500, 10 * time.Minute, 30 * time.Second, 5, 20},
+		{`untangle 127.0.0.1 8484 192.168.1.1 fe80::1 {
+			cache 0
+		}`, false, 0, 0, 0, 0, 0},
+		{`untangle 127.0.0.1 8484 192.168.1.1 fe80::1 {
+			cache -1
+		}`, true, 0, 0, 0, 0, 0},
+		{`untangle 127.0.0.1 8484 192.168.1.1 fe80::1 {
+			cache 100 -1s
+		}`, true, 0, 0, 0, 0, 0},
+		{`untangle 127.0.0.1 8484 192.168.1.1 fe80::1 {
+			prefetch 5 2m 95%
+		}`, true, 0, 0, 0, 0, 0},
+		{`untangle 127.0.0.1 8484 192.168.1.1 fe80::1 {
+			prefetch 5 2m ""
+		}`, true, 0, 0, 0, 0, 0},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		ut, err := parse(c)
+
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error but found one for input %s: %v", i, test.input, err)
+			continue
+		}
+		if test.expectedCap == 0 {
+			if ut.cache != nil {
+				t.Errorf("Test %d: expected cache to be disabled", i)
+			}
+			continue
+		}
+		if ut.cache == nil {
+			t.Errorf("Test %d: expected cache to be enabled", i)
+			continue
+		}
+		if ut.cache.cap != test.expectedCap || ut.cache.ttl != test.expectedTTL || ut.cache.nttl != test.expectedNTTL {
+			t.Errorf("Test %d: expected cache %d %s %s, got %d %s %s", i, test.expectedCap, test.expectedTTL, test.expectedNTTL, ut.cache.cap, ut.cache.ttl, ut.cache.nttl)
+		}
+		if ut.cache.prefetch != test.expectedPrefetch || ut.cache.percentage != test.expectedPercentage {
+			t.Errorf("Test %d: expected prefetch %d %d%%, got %d %d%%", i, test.expectedPrefetch, test.expectedPercentage, ut.cache.prefetch, ut.cache.percentage)
+		}
+	}
+}
+
+func TestSetupErrorHandling(t *testing.T) {
+	tests := []struct {
+		input            string
+		shouldErr        bool
+		expectedTimeout  time.Duration
+		expectedOnError  errorAction
+		expectedFails    int
+		expectedCooldown time.Duration
+	}{
+		{`untangle 127.0.0.1 8484 192.168.1.1 fe80::1`, false, defaultTimeout, errorAllow, defaultBreakerFails, defaultBreakerCooldown},
+		{`untangle 127.0.0.1 8484 192.168.1.1 fe80::1 {
+			timeout 500ms
+			on_error servfail
+			breaker 3 30s
+		}`, false, 500 * time.Millisecond, errorServfail, 3, 30 * time.Second},
+		{`untangle 127.0.0.1 8484 192.168.1.1 fe80::1 {
+			on_error block
+			breaker 0
+		}`, false, defaultTimeout, errorBlock, 0, defaultBreakerCooldown},
+		{`untangle 127.0.0.1 8484 192.168.1.1 fe80::1 {
+			on_error ignore
+		}`, true, 0, 0, 0, 0},
+		{`untangle 127.0.0.1 8484 192.168.1.1 fe80::1 {
+			timeout 0s
+		}`, true, 0, 0, 0, 0},
+		{`untangle 127.0.0.1 8484 192.168.1.1 fe80::1 {
+			breaker 3 0s
+		}`, true, 0, 0, 0, 0},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		ut, err := parse(c)
+
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error but found one for input %s: %v", i, test.input, err)
+			continue
+		}
+		if ut.timeout != test.expectedTimeout {
+			t.Errorf("Test %d: expected timeout %s, got %s", i, test.expectedTimeout, ut.timeout)
+		}
+		if ut.onError != test.expectedOnError {
+			t.Errorf("Test %d: expected on_error %d, got %d", i, test.expectedOnError, ut.onError)
+		}
+		if ut.breaker.threshold != test.expectedFails || ut.breaker.cooldown != test.expectedCooldown {
+			t.Errorf("Test %d: expected breaker %d %s, got %d %s", i, test.expectedFails, test.expectedCooldown, ut.breaker.threshold, ut.breaker.cooldown)
+		}
+	}
+}
+
+func TestSetupBlockSyntax(t *testing.T) {
+	c := caddy.NewTestController("dns", `untangle {
+		daemon 10.0.0.1:8484
+		policy_dir /tmp/policies
+		block_ipv4 192.0.2.1
+		block_ipv6 2001:db8::1
+		timeout 250ms
+		reload 5s
+		inspect_answers
+		batch 2ms 20
+		parent_fallback
+	}`)
+	ut, err := parse(c)
+	if err != nil {
+		t.Fatalf("Expected no error, got %v", err)
+	}
+	if ut.DaemonAddress != "10.0.0.1" || ut.DaemonPort != 8484 {
+		t.Errorf("Expected daemon 10.0.0.1:8484, got %s:%d", ut.DaemonAddress, ut.DaemonPort)
+	}
+	if ut.policyDir != "/tmp/policies" {
+		t.Errorf("Expected policy_dir /tmp/policies, got %s", ut.policyDir)
+	}
+	if ut.block4.String() != "192.0.2.1" || ut.block6.String() != "2001:db8::1" {
+		t.Errorf("Expected block addresses 192.0.2.1 and 2001:db8::1, got %s and %s", ut.block4, ut.block6)
+	}
+	if ut.timeout != 250*time.Millisecond {
+		t.Errorf("Expected timeout 250ms, got %s", ut.timeout)
+	}
+	if ut.reload != 5*time.Second {
+		t.Errorf("Expected reload 5s, got %s", ut.reload)
+	}
+	if !ut.inspect {
+		t.Errorf("Expected answer inspection to be enabled")
+	}
+	if !ut.parentFallback {
+		t.Errorf("Expected parent fallback to be enabled")
+	}
+	if ut.batchWindow != 2*time.Millisecond || ut.batchMax != 20 {
+		t.Errorf("Expected batch 2ms 20, got %s %d", ut.batchWindow, ut.batchMax)
+	}
+
+	for _, input := range []string{
+		`untangle {
+			inspect_answers yes
+		}`,
+		`untangle {
+			batch 1ms 0
+		}`,
+		`untangle {
+			parent_fallback on
+		}`,
+		`untangle {
+			batch -1ms
+		}`,
+	} {
+		c = caddy.NewTestController("dns", input)
+		if _, err := parse(c); err == nil {
+			t.Errorf("Expected error for input %s", input)
+		}
+	}
+}
+
+func TestSetupEvents(t *testing.T) {
+	tests := []struct {
+		input              string
+		shouldErr          bool
+		expectedErrContent string
+		expectedDest       string
+		expectedSize       int64
+		expectedKeep       int
+		expectedSample     int
+	}{
+		{`untangle`, false, "", "", 0, 0, 0},
+		{`untangle {
+			events /var/log/untangle.log
+		}`, false, "", "/var/log/untangle.log", 0, defaultEventKeep, 100},
+		{`untangle {
+			events udp:192.0.2.1:5140
+			events_sample 10%
+		}`, false, "", "udp:192.0.2.1:5140", 0, defaultEventKeep, 10},
+		{`untangle {
+			events_rotate 10 5
+			events /var/log/untangle.log
+		}`, false, "", "/var/log/untangle.log", 10 << 20, 5, 100},
+		{`untangle {
+			events tcp:192.0.2.1
+		}`, true, "invalid events destination", "", 0, 0, 0},
+		{`untangle {
+			events_sample 50%
+		}`, true, "need an events destination", "", 0, 0, 0},
+		{`untangle {
+			events /var/log/untangle.log
+			events_sample 101%
+		}`, true, "range [0, 100]", "", 0, 0, 0},
+		{`untangle {
+			events /var/log/untangle.log
+			events_sample ""
+		}`, true, "Wrong argument count", "", 0, 0, 0},
+		{`untangle {
+			events /var/log/untangle.log
+			events_rotate 0
+		}`, true, "must be positive", "", 0, 0, 0},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		ut, err := parse(c)
+
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			} else if !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error but found one for input %s: %v", i, test.input, err)
+			continue
+		}
+		if test.expectedDest == "" {
+			if ut.events != nil {
+				t.Errorf("Test %d: expected no event log, got %s", i, ut.events.dest)
+			}
+			continue
+		}
+		el := ut.events
+		if el == nil || el.dest != test.expectedDest || el.maxSize != test.expectedSize || el.keep != test.expectedKeep || el.sample != test.expectedSample {
+			t.Errorf("Test %d: expected event log %s %d %d %d, got %+v", i, test.expectedDest, test.expectedSize, test.expectedKeep, test.expectedSample, el)
+		}
+	}
+}
+
+func TestSetupClassifier(t *testing.T) {
+	f, err := ioutil.TempFile("", "categories")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("example.com 80 7\n")
+	f.Close()
+
+	tests := []struct {
+		input              string
+		shouldErr          bool
+		expectedErrContent string
+		expectedType       string
+	}{
+		{`untangle`, false, "", "<nil>"},
+		{`untangle {
+			classifier brightcloud
+		}`, false, "", "<nil>"},
+		{`untangle {
+			classifier file ` + f.Name() + `
+		}`, false, "", "*untangle.categoryFile"},
+		{`untangle {
+			classifier http https://classify.example.org/v1
+		}`, false, "", "*untangle.httpClassifier"},
+		{`untangle {
+			classifier file /nonexistent/categories
+		}`, true, "unable to read category file", ""},
+		{`untangle {
+			classifier http ftp://classify.example.org
+		}`, true, "invalid classifier url", ""},
+		{`untangle {
+			classifier vendor
+		}`, true, "unknown classifier", ""},
+		{`untangle {
+			classifier
+		}`, true, "Wrong argument count", ""},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		ut, err := parse(c)
+
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			} else if !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error but found one for input %s: %v", i, test.input, err)
+			continue
+		}
+		if got := fmt.Sprintf("%T", ut.classifier); got != test.expectedType {
+			t.Errorf("Test %d: expected classifier %s, got %s", i, test.expectedType, got)
+		}
+	}
+}
+
+func TestSetupClientID(t *testing.T) {
+	tests := []struct {
+		input              string
+		shouldErr          bool
+		expectedErrContent string
+		expectedIdentify   int
+		expectedOption     uint16
+		expectedTrusted    int
+	}{
+		{`untangle`, false, "", 0, defaultMACOption, 0},
+		{`untangle {
+			client_id mac ecs
+			mac_option 65074
+			trusted_forwarders 10.0.0.0/8 fd00::1
+		}`, false, "", 2, 65074, 2},
+		{`untangle {
+			client_id ecs
+		}`, true, "needs trusted_forwarders", 0, 0, 0},
+		{`untangle {
+			client_id arp
+			trusted_forwarders 10.0.0.1
+		}`, true, "client_id must be ecs or mac", 0, 0, 0},
+		{`untangle {
+			mac_option 70000
+		}`, true, "invalid EDNS0 option code", 0, 0, 0},
+		{`untangle {
+			trusted_forwarders 10.0.0.0/33
+		}`, true, "invalid trusted forwarder", 0, 0, 0},
+		{`untangle {
+			trusted_forwarders
+		}`, true, "Wrong argument count", 0, 0, 0},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		ut, err := parse(c)
+
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			} else if !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error but found one for input %s: %v", i, test.input, err)
+			continue
+		}
+		if len(ut.identify) != test.expectedIdentify || ut.macOption != test.expectedOption || len(ut.trustedForwarders) != test.expectedTrusted {
+			t.Errorf("Test %d: expected %d methods, option %d and %d forwarders, got %v %d %v", i, test.expectedIdentify, test.expectedOption, test.expectedTrusted, ut.identify, ut.macOption, ut.trustedForwarders)
+		}
+	}
+}
+
+func TestSetupBlocklist(t *testing.T) {
+	f, err := ioutil.TempFile("", "blocklist")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	tests := []struct {
+		input              string
+		shouldErr          bool
+		expectedErrContent string
+		expectedLists      []string
+		expectedRefresh    time.Duration // of the last list
+	}{
+		{`untangle`, false, "", nil, 0},
+		{`untangle {
+			blocklist ads https://lists.example.org/ads.txt
+			blocklist malware ` + f.Name() + ` 10m
+		}`, false, "", []string{"ads", "malware"}, 10 * time.Minute},
+		{`untangle {
+			blocklist ads ` + f.Name() + `
+			blocklist ads https://lists.example.org/ads.txt
+		}`, true, "duplicate blocklist", nil, 0},
+		{`untangle {
+			blocklist ads /nonexistent/ads.txt
+		}`, true, "unable to read blocklist", nil, 0},
+		{`untangle {
+			blocklist ads https:///ads.txt
+		}`, true, "invalid blocklist url", nil, 0},
+		{`untangle {
+			blocklist ads ` + f.Name() + ` 0s
+		}`, true, "must be positive", nil, 0},
+		{`untangle {
+			blocklist ads
+		}`, true, "Wrong argument count", nil, 0},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		ut, err := parse(c)
+
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			} else if !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error but found one for input %s: %v", i, test.input, err)
+			continue
+		}
+		if len(ut.blocklists) != len(test.expectedLists) {
+			t.Errorf("Test %d: expected %d blocklists, got %d", i, len(test.expectedLists), len(ut.blocklists))
+			continue
+		}
+		for j, bl := range ut.blocklists {
+			if bl.name != test.expectedLists[j] || bl.category != blocklistCategoryBase+j+1 {
+				t.Errorf("Test %d: expected blocklist %s with category %d, got %s with %d", i, test.expectedLists[j], blocklistCategoryBase+j+1, bl.name, bl.category)
+			}
+		}
+		if n := len(ut.blocklists); n > 0 && ut.blocklists[n-1].refresh != test.expectedRefresh {
+			t.Errorf("Test %d: expected refresh %s, got %s", i, test.expectedRefresh, ut.blocklists[n-1].refresh)
+		}
+	}
+}
+
+func TestSetupRPZ(t *testing.T) {
+	f, err := ioutil.TempFile("", "rpz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.Close()
+
+	tests := []struct {
+		input              string
+		shouldErr          bool
+		expectedErrContent string
+		expectedZones      []string
+		expectedPrimaries  []string // of the last zone
+	}{
+		{`untangle`, false, "", nil, nil},
+		{`untangle {
+			rpz rpz.example.org file ` + f.Name() + ` 10m
+			rpz RPZ.example.net primary 192.0.2.53 [2001:db8::53]:5353
+		}`, false, "", []string{"rpz.example.org.", "rpz.example.net."}, []string{"192.0.2.53:53", "[2001:db8::53]:5353"}},
+		{`untangle {
+			rpz rpz.example.org file ` + f.Name() + `
+			rpz RPZ.example.org. primary 192.0.2.53
+		}`, true, "duplicate rpz zone", nil, nil},
+		{`untangle {
+			rpz rpz.example.org file /nonexistent/rpz.db
+		}`, true, "unable to read rpz zone", nil, nil},
+		{`untangle {
+			rpz rpz.example.org file ` + f.Name() + ` 0s
+		}`, true, "must be positive", nil, nil},
+		{`untangle {
+			rpz rpz.example.org file ` + f.Name() + ` 1h extra
+		}`, true, "Wrong argument count", nil, nil},
+		{`untangle {
+			rpz rpz.example.org primary ns.example.org
+		}`, true, "invalid rpz primary", nil, nil},
+		{`untangle {
+			rpz rpz.example.org secondary 192.0.2.53
+		}`, true, "must be file or primary", nil, nil},
+		{`untangle {
+			rpz rpz.example.org file
+		}`, true, "Wrong argument count", nil, nil},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		ut, err := parse(c)
+
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			} else if !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error but found one for input %s: %v", i, test.input, err)
+			continue
+		}
+		if len(ut.rpz) != len(test.expectedZones) {
+			t.Errorf("Test %d: expected %d rpz zones, got %d", i, len(test.expectedZones), len(ut.rpz))
+			continue
+		}
+		for j, z := range ut.rpz {
+			if z.origin != test.expectedZones[j] {
+				t.Errorf("Test %d: expected rpz zone %s, got %s", i, test.expectedZones[j], z.origin)
+			}
+		}
+		if n := len(ut.rpz); n > 0 && !reflect.DeepEqual(ut.rpz[n-1].primaries, test.expectedPrimaries) {
+			t.Errorf("Test %d: expected primaries %v, got %v", i, test.expectedPrimaries, ut.rpz[n-1].primaries)
+		}
+	}
+}
+
+func TestSetupAdmin(t *testing.T) {
+	tests := []struct {
+		input              string
+		shouldErr          bool
+		expectedErrContent string
+		expectedAddress    string // empty for no admin API
+	}{
+		{`untangle`, false, "", ""},
+		{`untangle {
+			admin
+		}`, false, "", defaultAdminAddress},
+		{`untangle {
+			admin 192.0.2.1:8080
+		}`, false, "", "192.0.2.1:8080"},
+		{`untangle {
+			admin 192.0.2.1
+		}`, true, "invalid admin address", ""},
+		{`untangle {
+			admin :8080 :8081
+		}`, true, "Wrong argument count", ""},
+	}
+
+	for i, test := range tests {
+		c := caddy.NewTestController("dns", test.input)
+		ut, err := parse(c)
+
+		if test.shouldErr {
+			if err == nil {
+				t.Errorf("Test %d: expected error but found none for input %s", i, test.input)
+			} else if !strings.Contains(err.Error(), test.expectedErrContent) {
+				t.Errorf("Test %d: expected error to contain: %v, found error: %v, input: %s", i, test.expectedErrContent, err, test.input)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Test %d: expected no error but found one for input %s: %v", i, test.input, err)
+			continue
+		}
+		address := ""
+		if ut.admin != nil {
+			address = ut.admin.addr
+		}
+		if address != test.expectedAddress {
+			t.Errorf("Test %d: expected admin address %q, got %q", i, test.expectedAddress, address)
+		}
+	}
+}
+
+func TestSetupAdminDuplicate(t *testing.T) {
+	c := caddy.NewTestController("dns", `untangle {
+		admin 127.0.0.1:8080
+	}`)
+	if _, err := parse(c); err != nil {
+		t.Fatalf("Expected no error for the first server block, got %v", err)
+	}
+
+	// another server block of the same instance
+	c2 := *c
+	c2.Dispenser = caddyfile.NewDispenser("Testfile", strings.NewReader(`untangle {
+		admin 127.0.0.1:8080
+	}`))
+	if _, err := parse(&c2); err == nil || !strings.Contains(err.Error(), "already used") {
+		t.Errorf("Expected the admin address to be already used, got %v", err)
+	}
+	c2.Dispenser = caddyfile.NewDispenser("Testfile", strings.NewReader(`untangle {
+		admin 127.0.0.1:8081
+	}`))
+	if _, err := parse(&c2); err != nil {
+		t.Errorf("Expected no error for another admin address, got %v", err)
+	}
+
+	// the server block of a new instance, after a reload
+	c = caddy.NewTestController("dns", `untangle {
+		admin 127.0.0.1:8080
+	}`)
+	if _, err := parse(c); err != nil {
+		t.Errorf("Expected no error after a reload, got %v", err)
+	}
+}
@@ -8,19 +8,20 @@
 package untangle
 
 import (
-	"bufio"
 	"context"
-	"encoding/json"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
 	"time"
 
-    "github.com/fsnotify/fsnotify"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/pkg/cache"
 	"github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/plugin/pkg/singleflight"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
-	"github.com/caddyserver/caddy"
+	"golang.org/x/net/publicsuffix"
 )
 
 // Untangle allows CoreDNS to submit DNS queries to a filter
@@ -30,6 +31,38 @@ type Untangle struct {
 	Next          plugin.Handler
 	DaemonAddress string
 	DaemonPort    int
+
+	block4    net.IP
+	block6    net.IP
+	policyDir string
+	policies  *policySet
+	reload    time.Duration
+
+	maxConns       int
+	hcInterval     time.Duration
+	pool           *pool
+	classifier     Classifier
+	cache          *verdictCache
+	inflight       *singleflight.Group
+	batch          *batcher
+	batchWindow    time.Duration
+	batchMax       int
+	parentFallback bool
+	breaker        *breaker
+	timeout        time.Duration
+	onError        errorAction
+	inspect        bool
+	events         *eventLog
+	blocklists     []*blocklist
+	rpz            []*rpzZone
+	admin          *admin
+
+	identify          []identifyMethod
+	macOption         uint16
+	trustedForwarders []*net.IPNet
+
+	// Testing.
+	now func() time.Time
 }
 
 type Category struct {
@@ -37,6 +70,17 @@ type Category struct {
 	Conf  int
 }
 
+// getInfoCommand is the url/getinfo request understood by the daemon.
+type getInfoCommand struct {
+	GetInfo getInfo `json:"url/getinfo"`
+}
+
+type getInfo struct {
+	Urls       []string `json:"urls"`
+	A1cat      int      `json:"a1cat"`
+	Reputation int      `json:"reputation"`
+}
+
 type Response struct {
 	Url        string
 	Reputation int
@@ -46,167 +90,485 @@ type Response struct {
 }
 
 // ServeDNS implements the plugin.Handler interface.
-func (ut Untangle) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+func (ut *Untangle) ServeDNS(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
 	state := request.Request{W: w, Req: r}
 	// we only care about queries with INET class
 	if state.QClass() != dns.ClassINET {
 		return plugin.NextOrFailure(ut.Name(), ut.Next, ctx, w, r)
 	}
 
-	// we only care about queries for A and AAAA records
-	if state.QType() != dns.TypeA && state.QType() != dns.TypeAAAA {
+	// every query type is filtered, otherwise a blocked name could still be
+	// reached through its CNAME, MX, SRV or HTTPS records
+
+	log.Debugf("QUERY: name:%s client:%s\n", state.Name(), state.IP())
+
+	// clients without a policy are never filtered
+	policy, client := ut.clientPolicy(state)
+	if policy == nil {
 		return plugin.NextOrFailure(ut.Name(), ut.Next, ctx, w, r)
 	}
 
-	log.Debugf("QUERY: name:%s client:%s\n", state.Name(), state.IP())
+	// the decision is recorded once the query has been answered
+	d := decisionFrom(ctx)
+	d.customer, d.client, d.action = policy.customerId, client, "allow"
+	defer ut.record(state, d)
+
+	res, err := ut.decide(state.Name(), client, rpzClient(client, state.IP()), state.Proto() == "tcp", policy, d)
+	switch res.kind {
+	case outcomeBlock:
+		return ut.block(w, r, state, policy, d)
+	case outcomeBypass:
+		return ut.blockBypass(w, r, state, policy, d, res.rcode)
+	case outcomeRewrite:
+		return ut.rewrite(ctx, w, r, state, res.target)
+	case outcomeRPZ:
+		if ut.rpzRespond(ctx, w, r, state, policy, d, res.rule) {
+			return dns.RcodeSuccess, nil
+		}
+	case outcomeServfail:
+		return dns.RcodeServerFailure, plugin.Error(ut.Name(), err)
+	case outcomeResolve:
+		// the name is allowed, check what it resolves to if asked to
+		if ut.rpzResponseTriggers() {
+			w = &rpzWriter{ResponseWriter: w, Untangle: ut, ctx: ctx, state: state, policy: policy, decision: d}
+		}
+		// without a verdict for the name the answer isn't inspected either
+		if ut.inspect && err == nil {
+			w = &ResponseWriter{ResponseWriter: w, Untangle: ut, state: state, policy: policy, decision: d}
+		}
+	}
+	return plugin.NextOrFailure(ut.Name(), ut.Next, ctx, w, r)
+}
+
+// outcomeKind says how a decided query is answered.
+type outcomeKind int
+
+const (
+	outcomeResolve  outcomeKind = iota // resolve the name and check the answer
+	outcomePass                        // resolve the name without any further checks
+	outcomeBlock                       // answer with the block action of the policy
+	outcomeBypass                      // answer a DNS bypass name with the rcode
+	outcomeRewrite                     // rewrite the name to the safe search target
+	outcomeRPZ                         // apply the rule of a response policy zone
+	outcomeServfail                    // the lookup failed, answer with SERVFAIL
+)
 
-	// pass the query name to the filterLookup function
-	daemon := fmt.Sprintf("%s:%d", ut.DaemonAddress, ut.DaemonPort)
-	filter := filterLookup(state.Name(), daemon)
+// outcome is what decide found has to be done with a query.
+type outcome struct {
+	kind   outcomeKind
+	rcode  int      // for outcomeBypass
+	target string   // for outcomeRewrite
+	rule   *rpzRule // for outcomeRPZ
+}
 
-	// if we get nothing from the filter we are done
-	if filter == nil {
-		return plugin.NextOrFailure(ut.Name(), ut.Next, ctx, w, r)
+// decide applies the policy of client, which sent the query for name from
+// addr, and records the outcome in d. Only the checks that need the answer,
+// the RPZ-IP and NSDNAME triggers and inspect_answers, are left for after
+// the name is resolved. The error is that of a failed daemon lookup, the
+// outcome then follows on_error. Both ServeDNS and the admin API use this, so
+// the order of the filters lives here only.
+func (ut *Untangle) decide(name, client string, addr net.IP, tcp bool, policy *policyHolder, d *decision) (outcome, error) {
+	// the allow and block domains of the policy override the daemon and the
+	// bypass list, but allowing a search engine doesn't turn off its safe mode
+	reason, listed, blocked := checkDomains(name, policy)
+	if blocked {
+		d.blockedBy(reason)
+		return outcome{kind: outcomeBlock}, nil
+	}
+	if policy.blockBypass && !listed {
+		if reason, rcode, ok := checkBypass(name); ok {
+			d.blockedBy(reason)
+			return outcome{kind: outcomeBypass, rcode: rcode}, nil
+		}
+	}
+	if target, ok := policy.safeSearch.target(name); ok {
+		d.action = "rewrite"
+		return outcome{kind: outcomeRewrite, target: target}, nil
+	}
+	if listed {
+		return outcome{kind: outcomePass}, nil
 	}
 
-	// pass the name, client, and policy result to the checkPolicy function
-	// and get back the address of the block server or nil to allow
-	blocker := checkPolicy(state.Name(), state.IP(), filter)
+	// the response policy zones come before the daemon, a PASSTHRU rule
+	// skips the rest of the filter and so does TCP-ONLY over TCP
+	if rule := ut.rpzQuery(addr, name); rule != nil {
+		if rule.action == rpzPassthru || (rule.action == rpzTCPOnly && tcp) {
+			return outcome{kind: outcomePass}, nil
+		}
+		d.blockedBy(rule.reason())
+		return outcome{kind: outcomeRPZ, rule: rule}, nil
+	}
 
-	// emtpy result from checkPolicy means we allow the query
-	if len(blocker) == 0 {
-		return plugin.NextOrFailure(ut.Name(), ut.Next, ctx, w, r)
+	// names on the blocklists of the policy don't need the daemon
+	now := ut.clock()
+	if reason, blocked := ut.checkLists(name, client, policy, now); blocked {
+		d.blockedBy(reason)
+		return outcome{kind: outcomeBlock}, nil
+	}
+
+	// get the reputation and categories for the query name, when that fails
+	// the query is allowed, blocked or answered with SERVFAIL depending on
+	// the client policy, or the server default
+	filter, err := ut.lookup(name)
+	if err != nil {
+		switch ut.errorAction(policy) {
+		case errorBlock:
+			log.Debugf("Lookup failed (%v) - Blocking %s for %s\n", err, name, client)
+			d.blockedBy(lookupFailedReason)
+			return outcome{kind: outcomeBlock}, err
+		case errorServfail:
+			d.action = "servfail"
+			return outcome{kind: outcomeServfail}, err
+		}
+		// without the daemon the answer can still hit a response policy zone
+		return outcome{kind: outcomeResolve}, err
+	}
+	d.filter = filter
+
+	// pass the name, client, policy and filter result to the checkPolicy
+	// function to find out if the query should be blocked
+	if filter != nil {
+		if reason, blocked := checkPolicy(name, client, policy, filter, now); blocked {
+			d.blockedBy(reason)
+			return outcome{kind: outcomeBlock}, nil
+		}
+	}
+	return outcome{kind: outcomeResolve}, nil
+}
+
+// record reports the decision d about the query in state.
+func (ut *Untangle) record(state request.Request, d *decision) {
+	QueryCount.WithLabelValues(d.customer).Inc()
+	switch d.action {
+	case "allow", "rewrite":
+		AllowCount.WithLabelValues(d.customer).Inc()
+	case "block":
+		category := ""
+		if d.reason.category > 0 {
+			category = strconv.Itoa(d.reason.category)
+		}
+		BlockCount.WithLabelValues(d.customer, d.reason.kind, category).Inc()
+	}
+
+	if ut.events != nil {
+		ut.events.record(state, d)
 	}
+}
 
-	// checkPolicy gave us a result so we need to block the query
+// lookupFailedReason is why a query is blocked by on_error block.
+var lookupFailedReason = blockReason{kind: "error", text: "filter lookup failed"}
+
+// errorAction returns what to do with a query of the policy when the lookup
+// fails, the policy setting takes precedence over the server one.
+func (ut *Untangle) errorAction(policy *policyHolder) errorAction {
+	if policy.onError != errorDefault {
+		return policy.onError
+	}
+	return ut.onError
+}
+
+// block answers the query according to the block action of the policy. The
+// default action answers A and AAAA queries with the address of the block
+// page; the policy addresses take precedence over the server ones, and if
+// there is no address of the right family the answer is NODATA. Queries for
+// other types get NODATA, so clients fall back to the address records.
+func (ut *Untangle) block(w dns.ResponseWriter, r *dns.Msg, state request.Request, policy *policyHolder, d *decision) (int, error) {
 	a := new(dns.Msg)
 	a.SetReply(r)
 	a.Authoritative = true
-	var rr dns.RR
 
-	if state.QType() == dns.TypeA {
-		rr = new(dns.A)
-		rr.(*dns.A).Hdr = dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeA, Class: state.QClass()}
-		rr.(*dns.A).A = net.ParseIP(blocker).To4()
-		a.Answer = []dns.RR{rr}
-	}
-	if state.QType() == dns.TypeAAAA {
-		rr = new(dns.AAAA)
-		rr.(*dns.AAAA).Hdr = dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeAAAA, Class: state.QClass()}
-		rr.(*dns.AAAA).AAAA = net.ParseIP(blocker)
-		a.Answer = []dns.RR{rr}
+	switch policy.action {
+	case blockNxdomain:
+		a.Rcode = dns.RcodeNameError
+	case blockRefused:
+		a.Rcode = dns.RcodeRefused
+		a.Authoritative = false
+	case blockNodata:
+	case blockCname:
+		hdr := dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeCNAME, Class: state.QClass()}
+		a.Answer = []dns.RR{&dns.CNAME{Hdr: hdr, Target: policy.cname}}
+	default:
+		switch state.QType() {
+		case dns.TypeA:
+			if ip := firstIP(policy.redirect4, ut.block4); ip != nil {
+				hdr := dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeA, Class: state.QClass()}
+				a.Answer = []dns.RR{&dns.A{Hdr: hdr, A: ip.To4()}}
+			}
+		case dns.TypeAAAA:
+			if ip := firstIP(policy.redirect6, ut.block6); ip != nil {
+				hdr := dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeAAAA, Class: state.QClass()}
+				a.Answer = []dns.RR{&dns.AAAA{Hdr: hdr, AAAA: ip}}
+			}
+		}
 	}
 
+	explain(a, state, policy.explain, d.reason)
+
 	w.WriteMsg(a)
 	return 0, nil
 }
 
+// Extended DNS Errors (RFC 8914). Our version of the dns library has no
+// type for the option, so it is sent as a local option.
+const (
+	edeOptionCode = 15
+	edeFiltered   = 17
+)
+
+// explain adds the reason a query was blocked to the answer a. The extended
+// error is only added when the client sent an OPT record.
+func explain(a *dns.Msg, state request.Request, mode explainMode, reason blockReason) {
+	if mode == 0 || reason.text == "" {
+		return
+	}
+	text := "blocked: " + reason.text
+
+	if mode&explainTXT != 0 {
+		hdr := dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeTXT, Class: state.QClass()}
+		a.Extra = append(a.Extra, &dns.TXT{Hdr: hdr, Txt: []string{text}})
+	}
+
+	if mode&explainEDE != 0 {
+		if state.SizeAndDo(a) {
+			o := a.IsEdns0()
+			data := append([]byte{0, edeFiltered}, text...)
+			o.Option = append(o.Option, &dns.EDNS0_LOCAL{Code: edeOptionCode, Data: data})
+		}
+	}
+}
+
+// firstIP returns the first non nil address.
+func firstIP(ips ...net.IP) net.IP {
+	for _, ip := range ips {
+		if ip != nil {
+			return ip
+		}
+	}
+	return nil
+}
+
+// clock returns the time policy schedules are evaluated at.
+func (ut *Untangle) clock() time.Time {
+	if ut.now != nil {
+		return ut.now()
+	}
+	return time.Now()
+}
+
 // Name implements the Handler interface.
-func (ut Untangle) Name() string { return "untangle" }
+func (ut *Untangle) Name() string { return "untangle" }
+
+// lookup returns the daemon response for qname, using the verdict cache
+// when it is enabled. A nil response without an error means the daemon
+// had nothing for the name.
+func (ut *Untangle) lookup(qname string) (*Response, error) {
+	if ut.cache == nil {
+		return ut.fetch(qname)
+	}
 
-func filterLookup(qname string, server string) *Response {
-	var response []Response
+	now := ut.cache.now().UTC()
+	if v, ok := ut.cache.get(qname, now); ok {
+		if ut.cache.shouldPrefetch(v, now) {
+			go ut.prefetch(qname, v, now)
+		}
+		return v.response, nil
+	}
 
-	// connect to this socket
-	conn, err := net.DialTimeout("tcp", server, time.Second)
+	response, err := ut.fetch(qname)
 	if err != nil {
-		log.Errorf("Error connecting to daemon %s: %v\n", server, err)
-		return nil
+		return nil, err
 	}
+	ut.cache.add(qname, response, now)
+	return response, nil
+}
 
-	// make sure the socket is closed
-	defer conn.Close()
+// lookupAll is lookup for several names. The names that aren't cached are
+// sent to the classifier together, so they cost a single lookup. When that
+// fails the error is returned with nil responses for those names.
+func (ut *Untangle) lookupAll(names []string) ([]*Response, error) {
+	responses := make([]*Response, len(names))
+	var (
+		now      time.Time
+		uncached []string
+		missing  []int // positions of the uncached names
+	)
+	if ut.cache != nil {
+		now = ut.cache.now().UTC()
+	}
+	for i, name := range names {
+		if ut.cache != nil {
+			if v, ok := ut.cache.get(name, now); ok {
+				if ut.cache.shouldPrefetch(v, now) {
+					go ut.prefetch(name, v, now)
+				}
+				responses[i] = v.response
+				continue
+			}
+		}
+		uncached = append(uncached, name)
+		missing = append(missing, i)
+	}
+	if len(uncached) == 0 {
+		return responses, nil
+	}
 
-	// send to socket
-	command := fmt.Sprintf("{\"url/getinfo\":{\"urls\":[\"" + qname + "\"],\"a1cat\":1, \"reputation\":1}}" + "\r\n")
-	log.Debugf("DAEMON COMMAND: %s\n", command)
-	conn.Write([]byte(command))
+	fetched, err := ut.guardedClassify(uncached)
+	if err != nil {
+		return responses, err
+	}
+	for j, i := range missing {
+		response := ut.fallback(names[i], fetched[j])
+		if ut.cache != nil {
+			ut.cache.add(names[i], response, now)
+		}
+		responses[i] = response
+	}
+	return responses, nil
+}
 
-	// listen for reply
-	message, err := bufio.NewReader(conn).ReadString('\n')
+// fetch asks the daemon about qname, falling back to its parent domains.
+func (ut *Untangle) fetch(qname string) (*Response, error) {
+	response, err := ut.coalescedLookup(qname)
 	if err != nil {
-		log.Errorf("Error reading from daemon: %v\n", err)
-		return nil
+		return nil, err
 	}
+	return ut.fallback(qname, response), nil
+}
 
-	log.Debugf("DAEMON RESPONSE: %s\n", message)
-	json.Unmarshal([]byte(message), &response)
+// fallback returns the response of the closest categorized parent domain of
+// qname when parent fallback is enabled and the daemon has no categories for
+// qname, without going above the registered domain. Otherwise it returns
+// response.
+func (ut *Untangle) fallback(qname string, response *Response) *Response {
+	if !ut.parentFallback || (response != nil && len(response.Cats) > 0) {
+		return response
+	}
 
-	return &response[0]
+	parent, ok := parentDomain(qname)
+	if !ok {
+		return response
+	}
+	// the parent lookup falls back to its own parent in turn
+	fallback, err := ut.lookup(parent)
+	if err != nil || fallback == nil || len(fallback.Cats) == 0 {
+		return response
+	}
+	log.Debugf("Using categories of %s for %s\n", parent, qname)
+	return fallback
 }
 
-func hook(event caddy.EventName, info interface{}) error {
-	if event != caddy.InstanceStartupEvent {
-		return nil
+// parentDomain returns the parent of qname, unless qname is a registered
+// domain such as example.com, a public suffix such as co.uk or an address,
+// which inspect_answers looks up as well.
+func parentDomain(qname string) (string, bool) {
+	name := strings.TrimSuffix(strings.ToLower(qname), ".")
+	if net.ParseIP(name) != nil {
+		return "", false
 	}
+	registered, err := publicsuffix.EffectiveTLDPlusOne(name)
+	if err != nil || len(name) <= len(registered) {
+		return "", false
+	}
+	i := strings.IndexByte(name, '.')
+	return dns.Fqdn(name[i+1:]), true
+}
 
-	instance := info.(*caddy.Instance)
-	// this should be an instance. ok to panic if not
-	/*
-
-	go func() {
-		tick := time.NewTicker(10 * time.Second)
+// coalescedLookup makes sure only one lookup for qname is in flight at a
+// time, concurrent lookups for the same name share its result.
+func (ut *Untangle) coalescedLookup(qname string) (*Response, error) {
+	if ut.inflight == nil {
+		return ut.guardedLookup(qname)
+	}
+	key := cache.Hash([]byte(strings.ToLower(qname)))
+	v, err := ut.inflight.Do(key, func() (interface{}, error) {
+		return ut.guardedLookup(qname)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Response), nil
+}
 
-		for {
-			select {
-			case <-tick.C:
-				corefile, err := caddy.LoadCaddyfile(instance.Caddyfile().ServerType())
-				if err != nil {
-					continue
-				}
-				_, err = instance.Restart(corefile)
-				if err != nil {
-					log.Errorf("Corefile changed but reload failed: %s", err)
-					continue
-				}
-				return
-			}
-		}
-	}()
-	*/
-
-    // creates a new file watcher
-    watcher, err := fsnotify.NewWatcher()
-    if err != nil {
-        fmt.Println("ERROR", err)
-    }
-    defer watcher.Close()
-
-    //
-    done := make(chan bool)
-
-    //
-    go func() {
-        for {
-            select {
-            // watch for events
-            case event := <-watcher.Events:
-                fmt.Printf("EVENT! %#v\n", event)
-				corefile, err := caddy.LoadCaddyfile(instance.Caddyfile().ServerType())
-				if err != nil {
-					continue
-				}
-				_, err = instance.Restart(corefile)
-				if err != nil {
-					log.Errorf("Corefile changed but reload failed: %s", err)
-					continue
-				}
+// guardedLookup passes the lookup to the daemon unless the circuit breaker
+// is open, and records the outcome with the breaker.
+func (ut *Untangle) guardedLookup(qname string) (*Response, error) {
+	if ut.breaker == nil {
+		return ut.filterLookup(qname)
+	}
+	if !ut.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+	response, err := ut.filterLookup(qname)
+	if err != nil {
+		ut.breaker.failure()
+		return nil, err
+	}
+	ut.breaker.success()
+	return response, nil
+}
 
+// guardedClassify is guardedLookup for names sent to the classifier in one
+// call, whether batching is enabled or not.
+func (ut *Untangle) guardedClassify(names []string) ([]*Response, error) {
+	if ut.breaker == nil {
+		return ut.classify(names)
+	}
+	if !ut.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+	responses, err := ut.classify(names)
+	if err != nil {
+		ut.breaker.failure()
+		return nil, err
+	}
+	ut.breaker.success()
+	return responses, nil
+}
 
-            // watch for errors
-            case err := <-watcher.Errors:
-                fmt.Println("ERROR", err)
-            }
-        }
-    }()
+// prefetch refreshes the cached verdict v for qname before it expires.
+func (ut *Untangle) prefetch(qname string, v *verdict, now time.Time) {
+	response, err := ut.fetch(qname)
+	if err != nil {
+		return
+	}
+	// keep the hit count so a popular name stays prefetched
+	fresh := ut.cache.add(qname, response, ut.cache.now().UTC())
+	fresh.Freq.Reset(now, v.Freq.Hits())
+}
 
-    // out of the box fsnotify can watch a single file, or a single directory
-    if err := watcher.Add("/etc/dnsproxy"); err != nil {
-        fmt.Println("ERROR", err)
-    }
+// filterLookup asks the classifier for the reputation and categories of
+// qname, batched with other lookups when batching is enabled.
+func (ut *Untangle) filterLookup(qname string) (*Response, error) {
+	if ut.batch != nil {
+		return ut.batch.lookup(qname)
+	}
 
-    <-done
+	responses, err := ut.classify([]string{qname})
+	if err != nil {
+		return nil, err
+	}
+	return responses[0], nil
+}
 
+// classify asks the classifier about names. Without a classifier the
+// daemon is asked over the pool.
+func (ut *Untangle) classify(names []string) ([]*Response, error) {
+	classifier := ut.classifier
+	if classifier == nil {
+		classifier = &brightcloud{pool: ut.pool}
+	}
 
-	return nil
+	// lookups are shared between queries by the cache, coalescing and
+	// batching, so the context of a single query doesn't apply
+	start := time.Now()
+	responses, err := classifier.Classify(context.Background(), names)
+	LookupDuration.Observe(time.Since(start).Seconds())
+	if err == nil && len(responses) != len(names) {
+		err = fmt.Errorf("classifier returned %d responses for %d names", len(responses), len(names))
+	}
+	if err != nil {
+		LookupFailureCount.Inc()
+		return nil, err
+	}
+	return responses, nil
 }
@@ -0,0 +1,459 @@
+package untangle
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// singlePolicy returns a policy set with a single policy for network.
+func singlePolicy(t *testing.T, network string, p *policyHolder) *policySet {
+	n, err := parsePrefix(network)
+	if err != nil {
+		t.Fatalf("Failed to parse %s: %v", network, err)
+	}
+	p.networkAddress = n.String()
+	ps := newPolicySet("")
+	ps.table.insert(n, p)
+	return ps
+}
+
+// downDaemon returns the address of a daemon that refuses connections.
+func downDaemon() string {
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestOnError(t *testing.T) {
+	tests := []struct {
+		server        errorAction
+		policy        errorAction
+		expectedRcode int
+		expectedA     string
+	}{
+		{errorAllow, errorDefault, dns.RcodeRefused, ""},
+		{errorBlock, errorDefault, dns.RcodeSuccess, "192.0.2.53"},
+		{errorServfail, errorDefault, dns.RcodeServerFailure, ""},
+		{errorAllow, errorBlock, dns.RcodeSuccess, "192.0.2.53"},
+		{errorBlock, errorAllow, dns.RcodeRefused, ""},
+	}
+
+	for i, tc := range tests {
+		ut := &Untangle{
+			Next:     test.NextHandler(dns.RcodeRefused, nil),
+			policies: singlePolicy(t, "10.240.0.0/16", &policyHolder{redirect4: net.ParseIP("192.0.2.53"), onError: tc.policy}),
+			pool:     newPool(downDaemon(), 1),
+			onError:  tc.server,
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, _ := ut.ServeDNS(context.TODO(), rec, m)
+		ut.pool.Stop()
+
+		if rec.Msg != nil {
+			rcode = rec.Msg.Rcode
+		}
+		if rcode != tc.expectedRcode {
+			t.Errorf("Test %d: expected rcode %d, got %d", i, tc.expectedRcode, rcode)
+			continue
+		}
+		if tc.expectedA == "" {
+			continue
+		}
+		if rec.Msg == nil || len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].(*dns.A).A.String() != tc.expectedA {
+			t.Errorf("Test %d: expected block answer %s, got %v", i, tc.expectedA, rec.Msg)
+		}
+	}
+}
+
+func TestOnErrorNoPolicy(t *testing.T) {
+	ut := &Untangle{
+		Next:     test.NextHandler(dns.RcodeRefused, nil),
+		policies: singlePolicy(t, "192.168.0.0/16", &policyHolder{redirect4: net.ParseIP("192.0.2.53")}),
+		pool:     newPool(downDaemon(), 1),
+		onError:  errorServfail,
+	}
+	defer ut.pool.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if rcode, _ := ut.ServeDNS(context.TODO(), rec, m); rcode != dns.RcodeRefused {
+		t.Errorf("Expected clients without a policy to be passed through, got rcode %d", rcode)
+	}
+}
+
+func TestBreakerSkipsDaemon(t *testing.T) {
+	ut := &Untangle{pool: newPool(downDaemon(), 1), breaker: newBreaker(1, defaultBreakerCooldown)}
+	defer ut.pool.Stop()
+
+	if _, err := ut.lookup("example.org."); err == nil || err == errCircuitOpen {
+		t.Fatalf("Expected a daemon error, got %v", err)
+	}
+	if _, err := ut.lookup("example.org."); err != errCircuitOpen {
+		t.Errorf("Expected %v, got %v", errCircuitOpen, err)
+	}
+}
+
+// categoryDaemon puts every name in category 7.
+func categoryDaemon(url string) Response {
+	return Response{Url: url, Reputation: 80, Cats: []Category{{Catid: 7, Conf: 90}}}
+}
+
+func TestBlockAddresses(t *testing.T) {
+	d := newFakeDaemon(t, categoryDaemon)
+	defer d.Close()
+
+	tests := []struct {
+		redirect4, redirect6 string
+		block4, block6       string
+		qtype                uint16
+		expected             string // empty for NODATA
+	}{
+		{"192.0.2.1", "2001:db8::1", "", "", dns.TypeA, "192.0.2.1"},
+		{"192.0.2.1", "2001:db8::1", "", "", dns.TypeAAAA, "2001:db8::1"},
+		{"192.0.2.1", "", "", "", dns.TypeAAAA, ""},
+		{"192.0.2.1", "", "198.51.100.1", "2001:db8::53", dns.TypeAAAA, "2001:db8::53"},
+		{"", "", "198.51.100.1", "2001:db8::53", dns.TypeA, "198.51.100.1"},
+		{"", "", "", "", dns.TypeA, ""},
+	}
+
+	for i, tc := range tests {
+		ut := &Untangle{
+			Next:   test.NextHandler(dns.RcodeRefused, nil),
+			pool:   newPool(d.Addr(), 1),
+			block4: net.ParseIP(tc.block4),
+			block6: net.ParseIP(tc.block6),
+			policies: singlePolicy(t, "10.240.0.0/16", &policyHolder{
+				blockCategories: []int{7},
+				redirect4:       net.ParseIP(tc.redirect4),
+				redirect6:       net.ParseIP(tc.redirect6),
+			}),
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		ut.ServeDNS(context.TODO(), rec, m)
+		ut.pool.Stop()
+
+		if rec.Msg == nil || rec.Msg.Rcode != dns.RcodeSuccess {
+			t.Errorf("Test %d: expected a NOERROR block answer, got %v", i, rec.Msg)
+			continue
+		}
+		if tc.expected == "" {
+			if len(rec.Msg.Answer) != 0 {
+				t.Errorf("Test %d: expected NODATA, got %v", i, rec.Msg.Answer)
+			}
+			continue
+		}
+		if len(rec.Msg.Answer) != 1 {
+			t.Errorf("Test %d: expected 1 answer, got %v", i, rec.Msg.Answer)
+			continue
+		}
+		var got net.IP
+		switch rr := rec.Msg.Answer[0].(type) {
+		case *dns.A:
+			got = rr.A
+		case *dns.AAAA:
+			got = rr.AAAA
+		}
+		if got.String() != tc.expected {
+			t.Errorf("Test %d: expected %s, got %s", i, tc.expected, got)
+		}
+	}
+}
+
+func TestBlockActions(t *testing.T) {
+	d := newFakeDaemon(t, categoryDaemon)
+	defer d.Close()
+
+	tests := []struct {
+		action        blockAction
+		expectedRcode int
+		expectedType  uint16 // of the answer, 0 for no answer
+	}{
+		{blockRedirect, dns.RcodeSuccess, dns.TypeA},
+		{blockNxdomain, dns.RcodeNameError, 0},
+		{blockRefused, dns.RcodeRefused, 0},
+		{blockNodata, dns.RcodeSuccess, 0},
+		{blockCname, dns.RcodeSuccess, dns.TypeCNAME},
+	}
+
+	for i, tc := range tests {
+		ut := &Untangle{
+			Next: test.NextHandler(dns.RcodeServerFailure, nil),
+			pool: newPool(d.Addr(), 1),
+			policies: singlePolicy(t, "10.240.0.0/16", &policyHolder{
+				blockCategories: []int{7},
+				redirect4:       net.ParseIP("192.0.2.1"),
+				action:          tc.action,
+				cname:           "block.example.net.",
+			}),
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		ut.ServeDNS(context.TODO(), rec, m)
+		ut.pool.Stop()
+
+		if rec.Msg == nil || rec.Msg.Rcode != tc.expectedRcode {
+			t.Errorf("Test %d: expected rcode %d, got %v", i, tc.expectedRcode, rec.Msg)
+			continue
+		}
+		if tc.expectedType == 0 {
+			if len(rec.Msg.Answer) != 0 {
+				t.Errorf("Test %d: expected no answer, got %v", i, rec.Msg.Answer)
+			}
+			continue
+		}
+		if len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].Header().Rrtype != tc.expectedType {
+			t.Errorf("Test %d: expected a %s answer, got %v", i, dns.TypeToString[tc.expectedType], rec.Msg.Answer)
+			continue
+		}
+		if cname, ok := rec.Msg.Answer[0].(*dns.CNAME); ok && cname.Target != "block.example.net." {
+			t.Errorf("Test %d: expected CNAME to block.example.net., got %s", i, cname.Target)
+		}
+	}
+}
+
+func TestBlockExplain(t *testing.T) {
+	d := newFakeDaemon(t, categoryDaemon)
+	defer d.Close()
+
+	tests := []struct {
+		mode        explainMode
+		edns        bool
+		expectedTXT bool
+		expectedEDE bool
+	}{
+		{0, true, false, false},
+		{explainTXT, false, true, false},
+		{explainEDE, true, false, true},
+		{explainEDE, false, false, false},
+		{explainEDE | explainTXT, true, true, true},
+	}
+
+	const expected = "blocked: category 7"
+	for i, tc := range tests {
+		ut := &Untangle{
+			Next: test.NextHandler(dns.RcodeServerFailure, nil),
+			pool: newPool(d.Addr(), 1),
+			policies: singlePolicy(t, "10.240.0.0/16", &policyHolder{
+				blockCategories: []int{7},
+				action:          blockNxdomain,
+				explain:         tc.mode,
+			}),
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", dns.TypeA)
+		if tc.edns {
+			m.SetEdns0(4096, false)
+		}
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		ut.ServeDNS(context.TODO(), rec, m)
+		ut.pool.Stop()
+
+		if rec.Msg == nil {
+			t.Errorf("Test %d: expected an answer", i)
+			continue
+		}
+		var txt, ede string
+		for _, rr := range rec.Msg.Extra {
+			switch rr := rr.(type) {
+			case *dns.TXT:
+				txt = rr.Txt[0]
+			case *dns.OPT:
+				for _, o := range rr.Option {
+					if l, ok := o.(*dns.EDNS0_LOCAL); ok && l.Code == edeOptionCode && len(l.Data) > 2 && l.Data[1] == edeFiltered {
+						ede = string(l.Data[2:])
+					}
+				}
+			}
+		}
+		if tc.expectedTXT != (txt == expected) {
+			t.Errorf("Test %d: expected TXT %t, got %q", i, tc.expectedTXT, txt)
+		}
+		if tc.expectedEDE != (ede == expected) {
+			t.Errorf("Test %d: expected extended error %t, got %q", i, tc.expectedEDE, ede)
+		}
+	}
+}
+
+func TestBlockAllTypes(t *testing.T) {
+	d := newFakeDaemon(t, categoryDaemon)
+	defer d.Close()
+
+	const typeHTTPS = 65 // not known to our version of the dns library
+
+	tests := []struct {
+		qtype         uint16
+		action        blockAction
+		expectedRcode int
+		expectedType  uint16 // of the answer, 0 for no answer
+	}{
+		{dns.TypeMX, blockRedirect, dns.RcodeSuccess, 0},
+		{dns.TypeTXT, blockRedirect, dns.RcodeSuccess, 0},
+		{typeHTTPS, blockRedirect, dns.RcodeSuccess, 0},
+		{dns.TypeSRV, blockNxdomain, dns.RcodeNameError, 0},
+		{dns.TypeCNAME, blockRefused, dns.RcodeRefused, 0},
+		{dns.TypeMX, blockCname, dns.RcodeSuccess, dns.TypeCNAME},
+		{typeHTTPS, blockCname, dns.RcodeSuccess, dns.TypeCNAME},
+	}
+
+	for i, tc := range tests {
+		ut := &Untangle{
+			Next: test.NextHandler(dns.RcodeServerFailure, nil),
+			pool: newPool(d.Addr(), 1),
+			policies: singlePolicy(t, "10.240.0.0/16", &policyHolder{
+				blockCategories: []int{7},
+				redirect4:       net.ParseIP("192.0.2.1"),
+				action:          tc.action,
+				cname:           "block.example.net.",
+			}),
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion("example.org.", tc.qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		ut.ServeDNS(context.TODO(), rec, m)
+		ut.pool.Stop()
+
+		if rec.Msg == nil || rec.Msg.Rcode != tc.expectedRcode {
+			t.Errorf("Test %d: expected rcode %d, got %v", i, tc.expectedRcode, rec.Msg)
+			continue
+		}
+		if tc.expectedType == 0 && len(rec.Msg.Answer) != 0 {
+			t.Errorf("Test %d: expected no answer, got %v", i, rec.Msg.Answer)
+		}
+		if tc.expectedType != 0 && (len(rec.Msg.Answer) != 1 || rec.Msg.Answer[0].Header().Rrtype != tc.expectedType) {
+			t.Errorf("Test %d: expected a %s answer, got %v", i, dns.TypeToString[tc.expectedType], rec.Msg.Answer)
+		}
+	}
+}
+
+func TestAllowAllTypes(t *testing.T) {
+	d := newFakeDaemon(t, categoryDaemon)
+	defer d.Close()
+
+	ut := &Untangle{
+		Next:     test.NextHandler(dns.RcodeRefused, nil),
+		pool:     newPool(d.Addr(), 1),
+		policies: singlePolicy(t, "10.240.0.0/16", &policyHolder{blockCategories: []int{8}}),
+	}
+	defer ut.pool.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.org.", dns.TypeMX)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if rcode, _ := ut.ServeDNS(context.TODO(), rec, m); rcode != dns.RcodeRefused {
+		t.Errorf("Expected an allowed MX query to be passed on, got rcode %d", rcode)
+	}
+	if x := atomic.LoadInt32(&d.queries); x != 1 {
+		t.Errorf("Expected the MX query to be looked up, got %d daemon queries", x)
+	}
+}
+
+func TestPolicyDomains(t *testing.T) {
+	d := newFakeDaemon(t, categoryDaemon)
+	defer d.Close()
+
+	allow, _ := parseDomain("allowed.example.org")
+	block, _ := parseDomain("*.example.com")
+	tests := []struct {
+		qname         string
+		expectedRcode int
+		expectedCalls int32
+	}{
+		{"www.allowed.example.org.", dns.RcodeRefused, 0},
+		{"www.example.com.", dns.RcodeNameError, 0},
+		{"example.com.", dns.RcodeNameError, 1},
+		{"www.example.org.", dns.RcodeNameError, 1},
+	}
+
+	for i, tc := range tests {
+		before := atomic.LoadInt32(&d.queries)
+		ut := &Untangle{
+			Next: test.NextHandler(dns.RcodeRefused, nil),
+			pool: newPool(d.Addr(), 1),
+			policies: singlePolicy(t, "10.240.0.0/16", &policyHolder{
+				blockCategories: []int{7},
+				action:          blockNxdomain,
+				allowDomains:    domainList{allow},
+				blockDomains:    domainList{block},
+			}),
+		}
+
+		m := new(dns.Msg)
+		m.SetQuestion(tc.qname, dns.TypeA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		rcode, _ := ut.ServeDNS(context.TODO(), rec, m)
+		ut.pool.Stop()
+
+		if rec.Msg != nil {
+			rcode = rec.Msg.Rcode
+		}
+		if rcode != tc.expectedRcode {
+			t.Errorf("Test %d: expected rcode %d, got %d", i, tc.expectedRcode, rcode)
+		}
+		if x := atomic.LoadInt32(&d.queries) - before; x != tc.expectedCalls {
+			t.Errorf("Test %d: expected %d daemon queries, got %d", i, tc.expectedCalls, x)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	d := newFakeDaemon(t, badDaemon)
+	defer d.Close()
+
+	p := &policyHolder{customerId: "metrics", blockCategories: []int{7}, minimumReputation: 50}
+	ut := &Untangle{
+		Next:     test.NextHandler(dns.RcodeSuccess, nil),
+		pool:     newPool(d.Addr(), 1),
+		policies: singlePolicy(t, "10.240.0.0/16", p),
+	}
+	defer ut.pool.Stop()
+
+	// the counters are global, only what the queries add is checked
+	queries := testutil.ToFloat64(QueryCount.WithLabelValues("metrics"))
+	allowed := testutil.ToFloat64(AllowCount.WithLabelValues("metrics"))
+	byCategory := testutil.ToFloat64(BlockCount.WithLabelValues("metrics", "category", "7"))
+	byReputation := testutil.ToFloat64(BlockCount.WithLabelValues("metrics", "reputation", ""))
+
+	for _, name := range []string{"www.example.org.", "www.bad.example.", "www.bad.example."} {
+		m := new(dns.Msg)
+		m.SetQuestion(name, dns.TypeA)
+		ut.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter{}), m)
+	}
+
+	if v := testutil.ToFloat64(QueryCount.WithLabelValues("metrics")) - queries; v != 3 {
+		t.Errorf("Expected 3 queries, got %v", v)
+	}
+	if v := testutil.ToFloat64(AllowCount.WithLabelValues("metrics")) - allowed; v != 1 {
+		t.Errorf("Expected 1 allowed query, got %v", v)
+	}
+	if v := testutil.ToFloat64(BlockCount.WithLabelValues("metrics", "category", "7")) - byCategory; v != 2 {
+		t.Errorf("Expected 2 queries blocked by category 7, got %v", v)
+	}
+
+	p.minimumReputation = 90
+	m := new(dns.Msg)
+	m.SetQuestion("www.example.org.", dns.TypeA)
+	ut.ServeDNS(context.TODO(), dnstest.NewRecorder(&test.ResponseWriter{}), m)
+	if v := testutil.ToFloat64(BlockCount.WithLabelValues("metrics", "reputation", "")) - byReputation; v != 1 {
+		t.Errorf("Expected 1 query blocked by reputation, got %v", v)
+	}
+}
@@ -0,0 +1,235 @@
+/*
+ * validate.go
+ * This is the policy file validation for the Untangle DNS filter proxy
+ * Policy files are checked against schema.json before they are used, so a
+ * malformed file is rejected with a precise error instead of turning into
+ * a zero valued policy. Only the parts of JSON schema that schema.json
+ * uses are implemented here.
+ */
+
+//go:generate go run schema_generate.go
+
+package untangle
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// schemaNode is the subset of a JSON schema (draft-06) we understand.
+type schemaNode struct {
+	Ref         string                 `json:"$ref"`
+	Type        string                 `json:"type"`
+	Required    []string               `json:"required"`
+	Properties  map[string]*schemaNode `json:"properties"`
+	Items       *schemaNode            `json:"items"`
+	Enum        []interface{}          `json:"enum"`
+	Minimum     *float64               `json:"minimum"`
+	Maximum     *float64               `json:"maximum"`
+	MinLength   *int                   `json:"minLength"`
+	Definitions map[string]*schemaNode `json:"definitions"`
+}
+
+// rootSchema is the parsed policy schema.
+var rootSchema = mustParseSchema(policySchema)
+
+func mustParseSchema(s string) *schemaNode {
+	root := new(schemaNode)
+	if err := json.Unmarshal([]byte(s), root); err != nil {
+		panic(fmt.Sprintf("untangle: invalid policy schema: %v", err))
+	}
+	return root
+}
+
+// fileError lists everything that is wrong with a policy file.
+type fileError struct {
+	file string
+	errs []error
+}
+
+func (e *fileError) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("policy file %s: %s", e.file, strings.Join(msgs, "; "))
+}
+
+// ValidatePolicyFile checks the policy file at path against the policy
+// schema and the semantic rules applied when policies are loaded.
+func ValidatePolicyFile(path string) error {
+	_, err := loadFile(path)
+	return err
+}
+
+// parseConfiguration validates buf against the policy schema and decodes it.
+func parseConfiguration(buf []byte) (*Configuration, []error) {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, []error{err}
+	}
+
+	if errs := rootSchema.validate("", doc); len(errs) > 0 {
+		return nil, errs
+	}
+
+	config := new(Configuration)
+	if err := json.Unmarshal(buf, config); err != nil {
+		return nil, []error{err}
+	}
+	return config, nil
+}
+
+// validate checks v against the schema node s, path names v in errors.
+func (s *schemaNode) validate(path string, v interface{}) []error {
+	if s.Ref != "" {
+		ref, err := rootSchema.resolve(s.Ref)
+		if err != nil {
+			return []error{err}
+		}
+		return ref.validate(path, v)
+	}
+
+	if s.Type != "" && !hasType(v, s.Type) {
+		return []error{fmt.Errorf("%s: expected %s, got %s", location(path), s.Type, typeOf(v))}
+	}
+
+	var errs []error
+	if len(s.Enum) > 0 && !inEnum(v, s.Enum) {
+		errs = append(errs, fmt.Errorf("%s: %s is not one of %s", location(path), jsonString(v), jsonString(s.Enum)))
+	}
+
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for _, name := range s.Required {
+			if _, ok := x[name]; !ok {
+				errs = append(errs, fmt.Errorf("%s: missing required property %q", location(path), name))
+			}
+		}
+		names := make([]string, 0, len(x))
+		for name := range x {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if prop, ok := s.Properties[name]; ok {
+				errs = append(errs, prop.validate(join(path, name), x[name])...)
+			}
+		}
+
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range x {
+				errs = append(errs, s.Items.validate(fmt.Sprintf("%s[%d]", path, i), item)...)
+			}
+		}
+
+	case json.Number:
+		f, _ := x.Float64()
+		if s.Minimum != nil && f < *s.Minimum {
+			errs = append(errs, fmt.Errorf("%s: %s is less than the minimum %v", location(path), x, *s.Minimum))
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			errs = append(errs, fmt.Errorf("%s: %s is greater than the maximum %v", location(path), x, *s.Maximum))
+		}
+
+	case string:
+		if s.MinLength != nil && len(x) < *s.MinLength {
+			errs = append(errs, fmt.Errorf("%s: must be at least %d characters long", location(path), *s.MinLength))
+		}
+	}
+	return errs
+}
+
+// resolve returns the definition a local reference such as
+// "#/definitions/policy_settings" points to.
+func (s *schemaNode) resolve(ref string) (*schemaNode, error) {
+	const prefix = "#/definitions/"
+	if !strings.HasPrefix(ref, prefix) {
+		return nil, fmt.Errorf("unsupported schema reference %q", ref)
+	}
+	def, ok := s.Definitions[strings.TrimPrefix(ref, prefix)]
+	if !ok {
+		return nil, fmt.Errorf("unknown schema reference %q", ref)
+	}
+	return def, nil
+}
+
+func hasType(v interface{}, typ string) bool {
+	switch typ {
+	case "integer":
+		n, ok := v.(json.Number)
+		if !ok {
+			return false
+		}
+		_, err := n.Int64()
+		return err == nil
+	case "number":
+		_, ok := v.(json.Number)
+		return ok
+	}
+	return typeOf(v) == typ
+}
+
+func typeOf(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func inEnum(v interface{}, enum []interface{}) bool {
+	for _, e := range enum {
+		switch x := v.(type) {
+		case string:
+			if s, ok := e.(string); ok && s == x {
+				return true
+			}
+		case json.Number:
+			f, _ := x.Float64()
+			if n, ok := e.(float64); ok && n == f {
+				return true
+			}
+		case bool:
+			if b, ok := e.(bool); ok && b == x {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func join(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func location(path string) string {
+	if path == "" {
+		return "document"
+	}
+	return path
+}
+
+func jsonString(v interface{}) string {
+	buf, _ := json.Marshal(v)
+	return string(buf)
+}
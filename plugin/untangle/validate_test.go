@@ -0,0 +1,148 @@
+package untangle
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSchemaInSync(t *testing.T) {
+	buf, err := ioutil.ReadFile("schema.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != policySchema {
+		t.Errorf("zschema.go is out of date, run go generate")
+	}
+}
+
+func TestParseConfiguration(t *testing.T) {
+	tests := []struct {
+		doc      string
+		expected []string // error substrings, nil for a valid document
+	}{
+		{customerA, nil},
+		{customerB, nil},
+		{`{"version": 1, "customerId": "x", "policies": []}`, nil},
+		{`{"version": 1, "customerId": "x", "policies": [`, []string{"unexpected EOF"}},
+		{`[]`, []string{"document: expected object, got array"}},
+		{`{"customerId": "x"}`, []string{`missing required property "version"`, `missing required property "policies"`}},
+		{`{"version": 0, "customerId": "", "policies": []}`, []string{"customerId: must be at least 1 characters long", "version: 0 is less than the minimum 1"}},
+		{`{"version": "1", "customerId": "x", "policies": []}`, []string{"version: expected integer, got string"}},
+		{`{"version": 1.5, "customerId": "x", "policies": []}`, []string{"version: expected integer, got number"}},
+		{`{"version": 1, "customerId": "x", "policies": [{"blockCategories": [1, 84, "2"]}]}`, []string{
+			"policies[0].blockCategories[1]: 84 is greater than the maximum 83",
+			"policies[0].blockCategories[2]: expected integer, got string",
+		}},
+		{`{"version": 1, "customerId": "x", "policies": [{"onError": "ignore"}]}`, []string{`policies[0].onError: "ignore" is not one of ["allow","block","servfail"]`}},
+		{`{"version": 1, "customerId": "x", "policies": [{"ipv4Addrs": "10.0.0.1"}]}`, []string{"policies[0].ipv4Addrs: expected array, got string"}},
+		{`{"version": 1, "customerId": "x", "policies": [{"schedules": [{"days": ["monday"], "blockReputation": 101}]}]}`, []string{
+			`policies[0].schedules[0].blockReputation: 101 is greater than the maximum 100`,
+			`policies[0].schedules[0].days[0]: "monday" is not one of`,
+		}},
+		{`{"version": 1, "customerId": "x", "policies": [{"safeSearch": "yes", "safeSearchEngines": ["google", "yahoo"], "youtubeRestrict": "off"}]}`, []string{
+			"policies[0].safeSearch: expected boolean, got string",
+			`policies[0].safeSearchEngines[1]: "yahoo" is not one of ["google","bing","duckduckgo","youtube"]`,
+			`policies[0].youtubeRestrict: "off" is not one of ["strict","moderate"]`,
+		}},
+		{`{"version": 1, "customerId": "x", "policies": [{"blockLists": ["ads", ""]}]}`, []string{"policies[0].blockLists[1]: must be at least 1 characters long"}},
+		{`{"version": 1, "customerId": "x", "policies": [{"blockDnsBypass": 1}]}`, []string{"policies[0].blockDnsBypass: expected boolean, got number"}},
+		{`{"version": 1, "customerId": "x", "policies": [{"devices": ["00:11:22:33:44:55", ""]}]}`, []string{"policies[0].devices[1]: must be at least 1 characters long"}},
+		{`{"version": 1, "customerId": "x", "policies": [{"blockAction": "drop", "blockExplain": "always"}]}`, []string{
+			`policies[0].blockAction: "drop" is not one of ["redirect","nxdomain","refused","nodata","cname"]`,
+			`policies[0].blockExplain: "always" is not one of ["none","ede","txt","both"]`,
+		}},
+	}
+
+	for i, tc := range tests {
+		_, errs := parseConfiguration([]byte(tc.doc))
+		if len(errs) != len(tc.expected) {
+			t.Errorf("Test %d: expected %d errors, got %v", i, len(tc.expected), errs)
+			continue
+		}
+		for j, err := range errs {
+			if !strings.Contains(err.Error(), tc.expected[j]) {
+				t.Errorf("Test %d: expected error %q, got %q", i, tc.expected[j], err)
+			}
+		}
+	}
+}
+
+func TestCompileConfiguration(t *testing.T) {
+	tests := []struct {
+		doc      string
+		expected []string
+	}{
+		{customerA, nil},
+		{`{"version": 1, "customerId": "x", "policies": [{"ipv4Addrs": ["10.0.0.0/8", "10.0.0.256", "2001:db8::1"]}]}`, []string{
+			`policies[0].ipv4Addrs[1]: invalid network address "10.0.0.256"`,
+			`policies[0].ipv4Addrs[2]: "2001:db8::1" is in the wrong address family`,
+		}},
+		{`{"version": 1, "customerId": "x", "policies": [{}, {"ipv6Addrs": ["10.0.0.1"], "redirectIp": "blockpage"}]}`, []string{
+			`policies[1].redirectIp: invalid address "blockpage"`,
+			`policies[1].ipv6Addrs[0]: "10.0.0.1" is in the wrong address family`,
+		}},
+		{`{"version": 1, "customerId": "x", "policies": [{"ipv6Addrs": ["::ffff:10.0.0.0/104", "::ffff:10.0.0.1"]}]}`, []string{
+			`policies[0].ipv6Addrs[0]: "::ffff:10.0.0.0/104" is in the wrong address family`,
+			`policies[0].ipv6Addrs[1]: "::ffff:10.0.0.1" is in the wrong address family`,
+		}},
+		{`{"version": 1, "customerId": "x", "policies": [{"redirectIpv4": "2001:db8::1", "redirectIpv6": "192.0.2.1"}]}`, []string{
+			`policies[0].redirectIpv4: invalid IPv4 address "2001:db8::1"`,
+			`policies[0].redirectIpv6: invalid IPv6 address "192.0.2.1"`,
+		}},
+		{`{"version": 1, "customerId": "x", "policies": [{"blockAction": "cname"}, {"blockCname": "a..b"}]}`, []string{
+			`policies[0].blockCname: required by blockAction "cname"`,
+			`policies[1].blockCname: invalid domain name "a..b"`,
+		}},
+		{`{"version": 1, "customerId": "x", "policies": [{"allowDomains": ["example.com", "*.example.net", "a.*.b"], "blockDomains": ["*.", "x..y"]}]}`, []string{
+			`policies[0].allowDomains[2]: invalid domain name "a.*.b"`,
+			`policies[0].blockDomains[0]: invalid domain name "*."`,
+			`policies[0].blockDomains[1]: invalid domain name "x..y"`,
+		}},
+		{`{"version": 1, "customerId": "x", "policies": [{"schedules": [{"start": "8:00", "end": "24:00", "timezone": "Mars/Olympus"}]}]}`, []string{
+			`policies[0].schedules[0].end: invalid time of day "24:00"`,
+			`policies[0].schedules[0].timezone: unknown time zone "Mars/Olympus"`,
+		}},
+	}
+
+	for i, tc := range tests {
+		config, errs := parseConfiguration([]byte(tc.doc))
+		if len(errs) > 0 {
+			t.Fatalf("Test %d: expected valid document, got %v", i, errs)
+		}
+		_, errs = compileConfiguration(config)
+		if len(errs) != len(tc.expected) {
+			t.Errorf("Test %d: expected %d errors, got %v", i, len(tc.expected), errs)
+			continue
+		}
+		for j, err := range errs {
+			if !strings.Contains(err.Error(), tc.expected[j]) {
+				t.Errorf("Test %d: expected error %q, got %q", i, tc.expected[j], err)
+			}
+		}
+	}
+}
+
+func TestValidatePolicyFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untangle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writePolicy(t, dir, "good.json", customerA)
+	writePolicy(t, dir, "bad.json", `{"version": 1, "policies": [{"redirectIp": "x"}]}`)
+
+	if err := ValidatePolicyFile(filepath.Join(dir, "good.json")); err != nil {
+		t.Errorf("Expected good.json to be valid, got %v", err)
+	}
+	err = ValidatePolicyFile(filepath.Join(dir, "bad.json"))
+	if err == nil || !strings.Contains(err.Error(), "bad.json") || !strings.Contains(err.Error(), "customerId") {
+		t.Errorf("Expected error for bad.json naming the missing customerId, got %v", err)
+	}
+	if err := ValidatePolicyFile(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("Expected error for a missing file")
+	}
+}
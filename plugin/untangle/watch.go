@@ -0,0 +1,83 @@
+/*
+ * watch.go
+ * This is the policy reloading for the Untangle DNS filter proxy
+ * We watch the policy directory and reload the policies in place when a
+ * file changes. Saving a file usually produces a burst of events, so we
+ * wait until the directory has been quiet for a moment before reloading.
+ */
+
+package untangle
+
+import (
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/log"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watch starts reloading the policies when files in the policy directory
+// change, delay after the last change.
+func (ps *policySet) watch(delay time.Duration) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Errorf("Unable to watch policy directory %s: %v\n", ps.dir, err)
+		return
+	}
+	// fsnotify only watches the directory itself, not its subdirectories
+	if err := watcher.Add(ps.dir); err != nil {
+		log.Errorf("Unable to watch policy directory %s: %v\n", ps.dir, err)
+		watcher.Close()
+		return
+	}
+
+	stop := make(chan struct{})
+	ps.Lock()
+	ps.stop = stop
+	ps.Unlock()
+
+	go func() {
+		defer watcher.Close()
+
+		var fire <-chan time.Time
+		for {
+			select {
+			case <-stop:
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if !strings.HasSuffix(event.Name, ".json") {
+					continue
+				}
+				log.Debugf("Policy file %s changed: %s\n", filepath.Base(event.Name), event.Op)
+				fire = time.After(delay)
+			case <-fire:
+				fire = nil
+				for _, err := range ps.load() {
+					log.Errorf("%v\n", err)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Errorf("Error watching policy directory %s: %v\n", ps.dir, err)
+			}
+		}
+	}()
+}
+
+// stopWatch stops watching the policy directory.
+func (ps *policySet) stopWatch() {
+	ps.Lock()
+	defer ps.Unlock()
+	if ps.stop != nil {
+		close(ps.stop)
+		ps.stop = nil
+	}
+}
+
+const defaultReloadDelay = 1 * time.Second
@@ -0,0 +1,63 @@
+package untangle
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPolicySetWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untangle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writePolicy(t, dir, "b.json", customerB)
+
+	ps := newPolicySet(dir)
+	if errs := ps.load(); len(errs) != 0 {
+		t.Fatalf("Expected no errors, got %v", errs)
+	}
+	if v := testutil.ToFloat64(PolicyVersion.WithLabelValues("b")); v != 3 {
+		t.Errorf("Expected version 3 for customer b, got %v", v)
+	}
+
+	delay := 100 * time.Millisecond
+	ps.watch(delay)
+	defer ps.stopWatch()
+
+	// a burst of writes results in the final content being loaded once
+	loads := testutil.ToFloat64(PolicyLoadCount.WithLabelValues("success"))
+	updated := strings.Replace(customerB, `"version": 3`, `"version": 4`, 1)
+	updated = strings.Replace(updated, "10.2.0.1", "10.2.0.0/24", 1)
+	for i := 0; i < 4; i++ {
+		writePolicy(t, dir, "b.json", customerB)
+		time.Sleep(delay / 10)
+	}
+	writePolicy(t, dir, "b.json", updated)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if p := ps.lookup("10.2.0.99"); p != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if p := ps.lookup("10.2.0.99"); p == nil || p.customerId != "b" {
+		t.Fatalf("Expected the updated policy of customer b to be loaded")
+	}
+	if v := testutil.ToFloat64(PolicyVersion.WithLabelValues("b")); v != 4 {
+		t.Errorf("Expected version 4 for customer b, got %v", v)
+	}
+
+	// give a reload for a write of the burst the time to show up
+	time.Sleep(2 * delay)
+	if v := testutil.ToFloat64(PolicyLoadCount.WithLabelValues("success")) - loads; v != 1 {
+		t.Errorf("Expected the burst of writes to cause 1 reload, got %v", v)
+	}
+}
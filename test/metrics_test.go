@@ -223,3 +223,34 @@ example.com:0 {
 		t.Errorf("Expected value %s for %s, but got %s", "", metricName, got)
 	}
 }
+
+func TestMetricsUntangle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untangle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policy := `{"version": 2, "customerId": "metrics", "policies": [{"ipv4Addrs": ["10.0.0.0/8"]}]}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "metrics.json"), []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	corefile := `example.org:0 {
+	prometheus localhost:0
+	untangle {
+		policy_dir ` + dir + `
+	}
+}
+`
+	srv, err := CoreDNSServer(corefile)
+	if err != nil {
+		t.Fatalf("Could not get CoreDNS serving instance: %s", err)
+	}
+	defer srv.Stop()
+
+	data := test.Scrape("http://" + metrics.ListenAddr + "/metrics")
+	got, labels := test.MetricValue("coredns_untangle_policy_version", data)
+	if got != "2" || labels["customer"] != "metrics" {
+		t.Errorf("Expected policy version 2 of customer metrics, got %s with %v", got, labels)
+	}
+}
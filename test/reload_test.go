@@ -80,6 +80,38 @@ func TestReloadHealth(t *testing.T) {
 	}
 }
 
+func TestReloadUntangleAdmin(t *testing.T) {
+	corefile := `
+.:0 {
+	untangle {
+		admin 127.0.0.1:52183
+	}
+}`
+	c, err := CoreDNSServer(corefile)
+	if err != nil {
+		if strings.Contains(err.Error(), inUse) {
+			return // meh, but don't error
+		}
+		t.Fatalf("Could not get service instance: %s", err)
+	}
+
+	// the new instance listens on the address of the old one
+	c1, err := c.Restart(NewInput(corefile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Stop()
+
+	resp, err := http.Get("http://127.0.0.1:52183/untangle/customers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected %d from the admin API after the reload, got %d", http.StatusOK, resp.StatusCode)
+	}
+}
+
 func TestReloadMetricsHealth(t *testing.T) {
 	corefile := `
 .:0 {
@@ -0,0 +1,78 @@
+package test
+
+import (
+	"bytes"
+	"io/ioutil"
+	golog "log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// syncBuffer is a bytes.Buffer the server can log to while the test reads it.
+type syncBuffer struct {
+	sync.Mutex
+	b bytes.Buffer
+}
+
+func (s *syncBuffer) Write(p []byte) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.b.Write(p)
+}
+
+func (s *syncBuffer) String() string {
+	s.Lock()
+	defer s.Unlock()
+	return s.b.String()
+}
+
+func TestUntangleLogBlock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "untangle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	policy := `{"version": 1, "customerId": "log", "policies": [{"ipv4Addrs": ["127.0.0.1"], "ipv6Addrs": ["::1"], "blockDomains": ["blocked.example.org"]}]}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "log.json"), []byte(policy), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	corefile := `example.org:0 {
+	metadata
+	log . "{name} {/untangle/action} {/untangle/reason}"
+	untangle {
+		policy_dir ` + dir + `
+	}
+}
+`
+	buf := new(syncBuffer)
+	golog.SetOutput(buf)
+	defer golog.SetOutput(ioutil.Discard)
+
+	srv, udp, _, err := CoreDNSServerAndPorts(corefile)
+	if err != nil {
+		t.Fatalf("Could not get CoreDNS serving instance: %s", err)
+	}
+	defer srv.Stop()
+
+	m := new(dns.Msg)
+	m.SetQuestion("blocked.example.org.", dns.TypeA)
+	if _, err := dns.Exchange(m, udp); err != nil {
+		t.Fatalf("Could not send message: %s", err)
+	}
+
+	// the query is logged once the answer is written
+	expected := "blocked.example.org. block domain"
+	for i := 0; i < 20 && !strings.Contains(buf.String(), expected); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !strings.Contains(buf.String(), expected) {
+		t.Errorf("Expected %q to be logged, got %q", expected, buf.String())
+	}
+}